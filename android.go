@@ -14,15 +14,16 @@ import (
 )
 
 func (t *TraceRoute) ExecCmd() error {
-	key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, 1)
-	db := NewStatsDB(key)
-	t.DB.Store(key, db)
-	go db.Cache.Run()
+	key := t.icmpFlowKey()
+	t.newFlow(key)
 
-	t.StartTime = time.Now()
-	lastHop := 30
+	t.markStart()
+	lastHop := t.MaxTTL
 	for c := 1; c <= t.Count; c++ {
-		for i := 1; i <= lastHop; i++ {
+		for i := t.firstTTL(); i <= lastHop; i++ {
+			if t.stopped() {
+				break
+			}
 			ttl := fmt.Sprintf("-t %d", i)
 			cmd := NewExecute()
 			m := &SendMetric{
@@ -45,8 +46,7 @@ func (t *TraceRoute) ExecCmd() error {
 				//t.LastHop = i
 			}
 		}
-		time.Sleep(t.Interval)
-		if t.IsFinish() {
+		if !t.sleep(t.Interval) || t.IsFinish() {
 			break
 		}
 	}
@@ -55,7 +55,7 @@ func (t *TraceRoute) ExecCmd() error {
 }
 
 func (t *TraceRoute) parseHopIp(text string, ttl int) string {
-	key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, 1)
+	key := t.icmpFlowKey()
 	var hopIp string
 	arr := strings.Split(text, "\n")
 	if len(arr) < 2 {
@@ -0,0 +1,214 @@
+package ztrace
+
+import (
+	"fmt"
+	"time"
+)
+
+// Config describes a trace. Fields left at their zero value take the
+// defaults listed next to them.
+type Config struct {
+	Protocol         string        // icmp, udp, tcp or android, default icmp
+	Dest             string        // destination host name or address
+	Src              string        // source address, default picked by the kernel
+	Af               string        // ip4 or ip6, default ip4
+	PingType         string        // icmp (raw socket) or udp (unprivileged), default icmp
+	Count            int           // probes per TTL, i.e. ECMP flows, default 3
+	Interval         time.Duration // pause between ICMP rounds, default 100ms
+	Timeout          time.Duration // time to wait for replies, default 2s
+	GlobalTimeout    time.Duration // hard limit for the whole trace, default 20s or what the packet rates need to probe every TTL
+	FirstTTL         int           // TTL of the first probes, to skip known local hops, default 1
+	MaxTTL           int           // default 30, at most 255
+	TCPDPort         uint16        // default 443
+	TCPProbePorts    []uint16      // default 80, 8080, 443, 8443, see TCPPortRange
+	TCPMultiPort     bool          // trace toward every port of TCPProbePorts instead of TCPDPort
+	PacketRate       float32       // probes per second of the trace, default 0 is unlimited, see SetGlobalPacketRate
+	WideMode         bool
+	PortOffset       int32
+	Paris            bool          // keep the load-balancer flow of every probe constant, see TraceRoute.Paris
+	MDA              bool          // enumerate ECMP next hops with MDA, udp and tcp only, see TraceRoute.TraceMDA
+	MDAConfidence    float64       // probability that MDA finds every next hop, default 0.95
+	GapLimit         int           // stop after this many silent TTLs in a row, default 0 is no limit
+	TOS              int           // DSCP and ECN bits of the probes, the IPv4 TOS or IPv6 traffic class, default 0
+	PMTU             bool          // discover the path MTU with probes that may not be fragmented, udp only, see TraceRoute.TracePMTU
+	MTU              int           // packet size PMTU probing starts from, default 1500
+	Continuous       bool          // probe round after round until stopped like mtr, GlobalTimeout then defaults to none
+	WindowCycles     int           // hop stats cover the last rounds only, default all, 100 in Continuous mode
+	WindowTime       time.Duration // hop stats cover the probes sent this long ago at most, default all
+	SnapshotInterval time.Duration // emit a Snapshot event this often, default never
+	Transport        Transport     // sockets for probes and replies, default SystemTransport
+	Observer         Observer      // receives probe and hop events as they happen
+}
+
+// ConfigError reports an invalid Config field.
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %s: %s", e.Field, e.Reason)
+}
+
+func (c *Config) setDefaults() {
+	if c.Protocol == "" {
+		c.Protocol = "icmp"
+	}
+	if c.Af == "" {
+		c.Af = "ip4"
+	}
+	if c.PingType == "" {
+		c.PingType = "icmp"
+	}
+	if c.Count == 0 {
+		c.Count = 3
+	}
+	if c.Interval == 0 {
+		c.Interval = 100 * time.Millisecond
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 2 * time.Second
+	}
+	if c.FirstTTL == 0 {
+		c.FirstTTL = 1
+	}
+	if c.MaxTTL == 0 {
+		c.MaxTTL = 30
+	}
+	if c.TCPDPort == 0 {
+		c.TCPDPort = 443
+	}
+	if c.TCPProbePorts == nil {
+		c.TCPProbePorts = []uint16{80, 8080, 443, 8443}
+	}
+	if c.PMTU && c.MTU == 0 {
+		c.MTU = 1500
+	}
+	if c.MDAConfidence == 0 {
+		c.MDAConfidence = 0.95
+	}
+	if c.Continuous && c.WindowCycles == 0 && c.WindowTime == 0 {
+		c.WindowCycles = defaultWindowCycles
+	}
+	if c.GlobalTimeout == 0 && !c.Continuous {
+		c.GlobalTimeout = 20 * time.Second
+		// 限速后20秒可能发不完所有探测包，报告会被截断
+		if d := c.pacedDuration(); d > c.GlobalTimeout {
+			c.GlobalTimeout = d
+		}
+	}
+}
+
+// pacedDuration is how long the slower of PacketRate and the global packet
+// rate takes to send one probe per flow to every TTL, plus Timeout for the
+// last replies. It is 0 when neither is set. Traces running at the same time
+// share the global rate, which this does not account for: set GlobalTimeout
+// explicitly for them.
+func (c *Config) pacedDuration() time.Duration {
+	probes := c.Count * (c.MaxTTL - c.FirstTTL + 1)
+	if c.TCPMultiPort {
+		probes *= len(c.TCPProbePorts)
+	}
+	rate := float64(c.PacketRate)
+	if g := GlobalPacketRate(); g > 0 && (rate <= 0 || g < rate) {
+		rate = g
+	}
+	if rate <= 0 || probes <= 0 {
+		return 0
+	}
+	return time.Duration(float64(probes)/rate*float64(time.Second)) + c.Timeout
+}
+
+// Validate checks every field and returns a *ConfigError naming the first
+// invalid one.
+func (c *Config) Validate() error {
+	switch c.Protocol {
+	case "icmp", "udp", "tcp", "android":
+	default:
+		return &ConfigError{"Protocol", fmt.Sprintf("unsupported protocol %q, only support tcp/udp/icmp", c.Protocol)}
+	}
+	if c.Dest == "" {
+		return &ConfigError{"Dest", "destination is required"}
+	}
+	if c.Af != "ip4" && c.Af != "ip6" {
+		return &ConfigError{"Af", fmt.Sprintf("unsupported address family %q, only support ip4/ip6", c.Af)}
+	}
+	if _, ok := ipv4Proto[c.PingType]; !ok {
+		return &ConfigError{"PingType", fmt.Sprintf("unsupported ping type %q, only support icmp/udp", c.PingType)}
+	}
+	if c.Count < 1 || c.Count > 32 {
+		return &ConfigError{"Count", "only support max ECMP = 32"}
+	}
+	if c.Interval < 0 {
+		return &ConfigError{"Interval", "must not be negative"}
+	}
+	if c.Timeout < 0 {
+		return &ConfigError{"Timeout", "must not be negative"}
+	}
+	if c.GlobalTimeout < 0 {
+		return &ConfigError{"GlobalTimeout", "must not be negative"}
+	}
+	if c.MaxTTL < 1 || c.MaxTTL > maxTTL {
+		return &ConfigError{"MaxTTL", fmt.Sprintf("must be between 1 and %d", maxTTL)}
+	}
+	if c.FirstTTL < 1 || c.FirstTTL > c.MaxTTL {
+		return &ConfigError{"FirstTTL", "must be between 1 and MaxTTL"}
+	}
+	if c.PacketRate < 0 {
+		return &ConfigError{"PacketRate", "must not be negative"}
+	}
+	if c.Paris && c.Protocol == "icmp" && c.PingType != "icmp" {
+		return &ConfigError{"Paris", "unprivileged ICMP sockets rewrite the echo ID, use PingType icmp"}
+	}
+	if c.MDA && c.Protocol != "udp" && c.Protocol != "tcp" {
+		return &ConfigError{"MDA", "only support udp/tcp probes"}
+	}
+	if c.TCPMultiPort {
+		if c.Protocol != "tcp" || c.MDA {
+			return &ConfigError{"TCPMultiPort", "only support tcp probes without MDA"}
+		}
+		if len(c.TCPProbePorts) < 1 || len(c.TCPProbePorts) > maxTCPProbePorts {
+			return &ConfigError{"TCPProbePorts", fmt.Sprintf("must have between 1 and %d ports", maxTCPProbePorts)}
+		}
+		seen := make(map[uint16]bool)
+		for _, port := range c.TCPProbePorts {
+			if port == 0 || seen[port] {
+				return &ConfigError{"TCPProbePorts", fmt.Sprintf("invalid or duplicate port %d", port)}
+			}
+			seen[port] = true
+		}
+	}
+	if c.MDAConfidence <= 0 || c.MDAConfidence >= 1 {
+		return &ConfigError{"MDAConfidence", "must be between 0 and 1"}
+	}
+	if c.Continuous && (c.MDA || c.Protocol == "android") {
+		return &ConfigError{"Continuous", "not supported with MDA or android probes"}
+	}
+	if c.TOS < 0 || c.TOS > 255 {
+		return &ConfigError{"TOS", "must be between 0 and 255"}
+	}
+	if c.PMTU {
+		if c.Protocol != "udp" || c.MDA || c.Continuous {
+			return &ConfigError{"PMTU", "only support udp probes without MDA or Continuous"}
+		}
+		if min := minMTU(c.Af); c.MTU < min || c.MTU > maxMTU {
+			return &ConfigError{"MTU", fmt.Sprintf("must be between %d and %d", min, maxMTU)}
+		}
+	}
+	if c.GapLimit < 0 {
+		return &ConfigError{"GapLimit", "must not be negative"}
+	}
+	if c.WindowCycles < 0 {
+		return &ConfigError{"WindowCycles", "must not be negative"}
+	}
+	if c.WindowTime < 0 {
+		return &ConfigError{"WindowTime", "must not be negative"}
+	}
+	if c.SnapshotInterval < 0 {
+		return &ConfigError{"SnapshotInterval", "must not be negative"}
+	}
+	if c.PortOffset < 0 || c.PortOffset > 64000 {
+		return &ConfigError{"PortOffset", "must be between 0 and 64000"}
+	}
+	return nil
+}
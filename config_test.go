@@ -0,0 +1,109 @@
+package ztrace
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	c := Config{Dest: "192.0.2.1"}
+	c.setDefaults()
+	if c.Protocol != "icmp" || c.Af != "ip4" || c.PingType != "icmp" {
+		t.Errorf("Protocol, Af, PingType = %v, %v, %v, want icmp, ip4, icmp", c.Protocol, c.Af, c.PingType)
+	}
+	if c.Count != 3 || c.Interval != 100*time.Millisecond || c.Timeout != 2*time.Second {
+		t.Errorf("Count, Interval, Timeout = %v, %v, %v, want 3, 100ms, 2s", c.Count, c.Interval, c.Timeout)
+	}
+	if c.GlobalTimeout != 20*time.Second || c.FirstTTL != 1 || c.MaxTTL != 30 {
+		t.Errorf("GlobalTimeout, FirstTTL, MaxTTL = %v, %v, %v, want 20s, 1, 30", c.GlobalTimeout, c.FirstTTL, c.MaxTTL)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("defaults do not validate: %v", err)
+	}
+
+	// 每秒1个包，3条流探测30跳要90秒
+	c = Config{Dest: "192.0.2.1", PacketRate: 1}
+	c.setDefaults()
+	if want := 92 * time.Second; c.GlobalTimeout != want {
+		t.Errorf("GlobalTimeout at PacketRate 1 = %v, want %v", c.GlobalTimeout, want)
+	}
+	c = Config{Dest: "192.0.2.1", PacketRate: 100}
+	c.setDefaults()
+	if c.GlobalTimeout != 20*time.Second {
+		t.Errorf("GlobalTimeout at PacketRate 100 = %v, want 20s", c.GlobalTimeout)
+	}
+	// 全局限速更慢时按全局速率算
+	SetGlobalPacketRate(2)
+	c = Config{Dest: "192.0.2.1", PacketRate: 100}
+	c.setDefaults()
+	SetGlobalPacketRate(0)
+	if want := 47 * time.Second; c.GlobalTimeout != want {
+		t.Errorf("GlobalTimeout at global rate 2 = %v, want %v", c.GlobalTimeout, want)
+	}
+
+	// 持续模式默认不限制总时长
+	c = Config{Dest: "192.0.2.1", Continuous: true}
+	c.setDefaults()
+	if c.GlobalTimeout != 0 || c.WindowCycles != defaultWindowCycles {
+		t.Errorf("Continuous GlobalTimeout, WindowCycles = %v, %v, want 0, %v", c.GlobalTimeout, c.WindowCycles, defaultWindowCycles)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(c *Config)
+		field string // "" if valid
+	}{
+		{"udp", func(c *Config) { c.Protocol = "udp" }, ""},
+		{"tcp", func(c *Config) { c.Protocol = "tcp" }, ""},
+		{"unknown protocol", func(c *Config) { c.Protocol = "sctp" }, "Protocol"},
+		{"no dest", func(c *Config) { c.Dest = "" }, "Dest"},
+		{"ip6", func(c *Config) { c.Af = "ip6" }, ""},
+		{"unknown af", func(c *Config) { c.Af = "ip5" }, "Af"},
+		{"unprivileged", func(c *Config) { c.PingType = "udp" }, ""},
+		{"unknown ping type", func(c *Config) { c.PingType = "raw" }, "PingType"},
+		{"max count", func(c *Config) { c.Count = 32 }, ""},
+		{"too many", func(c *Config) { c.Count = 33 }, "Count"},
+		{"negative count", func(c *Config) { c.Count = -1 }, "Count"},
+		{"negative timeout", func(c *Config) { c.Timeout = -time.Second }, "Timeout"},
+		{"negative global timeout", func(c *Config) { c.GlobalTimeout = -time.Second }, "GlobalTimeout"},
+		{"max ttl", func(c *Config) { c.MaxTTL = maxTTL }, ""},
+		{"ttl too large", func(c *Config) { c.MaxTTL = maxTTL + 1 }, "MaxTTL"},
+		{"negative ttl", func(c *Config) { c.MaxTTL = -1 }, "MaxTTL"},
+		{"first ttl past max", func(c *Config) { c.MaxTTL, c.FirstTTL = 5, 6 }, "FirstTTL"},
+		{"paris unprivileged icmp", func(c *Config) { c.Paris, c.PingType = true, "udp" }, "Paris"},
+	}
+	for _, tt := range tests {
+		c := Config{Dest: "192.0.2.1"}
+		c.setDefaults()
+		tt.set(&c)
+		err := c.Validate()
+		if tt.field == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		var ce *ConfigError
+		if !errors.As(err, &ce) || ce.Field != tt.field {
+			t.Errorf("%v: got %v, want a ConfigError for %v", tt.name, err, tt.field)
+		}
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	tr, err := New("icmp", "192.0.2.1", "192.0.2.2", "ip4", 0, 0, 0, "icmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Count != 3 || tr.Interval != 100*time.Millisecond || tr.Timeout != 2*time.Second {
+		t.Errorf("Count, Interval, Timeout = %v, %v, %v, want 3, 100ms, 2s", tr.Count, tr.Interval, tr.Timeout)
+	}
+
+	var ce *ConfigError
+	if _, err := New("sctp", "192.0.2.1", "192.0.2.2", "ip4", 3, 0, 1, "icmp"); !errors.As(err, &ce) || ce.Field != "Protocol" {
+		t.Errorf("New with protocol sctp: got %v, want a ConfigError for Protocol", err)
+	}
+}
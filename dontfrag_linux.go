@@ -0,0 +1,34 @@
+package ztrace
+
+import (
+	"net"
+	"syscall"
+)
+
+// ipv6DontFrag is IPV6_DONTFRAG, which the syscall package lacks.
+const ipv6DontFrag = 62
+
+// setDontFragment6 makes the IPv6 socket c fail with EMSGSIZE instead of
+// fragmenting packets larger than the link MTU, and ignore the path MTU the
+// kernel has cached so that PMTU probes measure the path themselves.
+func setDontFragment6(c net.PacketConn) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1); serr != nil {
+			return
+		}
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package ztrace
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// setDontFragment6 fails where IPV6_DONTFRAG is not wired up: the kernel
+// would fragment IPv6 PMTU probes and the local MTU would pass for the path
+// MTU.
+func setDontFragment6(c net.PacketConn) error {
+	return fmt.Errorf("IPv6 PMTU probing is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,132 @@
+package ztrace
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies what an Event reports.
+type EventType int
+
+const (
+	ProbeSent EventType = iota + 1
+	ReplyReceived
+	ProbeTimedOut
+	DestinationReached
+	HopUpdated
+	Snapshot
+)
+
+var eventTypeNames = map[EventType]string{
+	ProbeSent:          "ProbeSent",
+	ReplyReceived:      "ReplyReceived",
+	ProbeTimedOut:      "ProbeTimedOut",
+	DestinationReached: "DestinationReached",
+	HopUpdated:         "HopUpdated",
+	Snapshot:           "Snapshot",
+}
+
+func (e EventType) String() string {
+	if s, ok := eventTypeNames[e]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// Event is delivered to the Observer while the trace runs. Fields that do
+// not apply to the event type are left zero.
+type Event struct {
+	Type          EventType
+	Time          time.Time
+	FlowKey       string
+	ID            uint32
+	TTL           int
+	Responder     string
+	RTT           time.Duration
+	ICMPType      int
+	ICMPCode      int
+	MPLS          []MPLSLabel     // label stack quoted by the responder, if any
+	InterfaceInfo []InterfaceInfo // RFC 5837 objects quoted by the responder
+	ReplyTTL      int             // TTL the reply arrived with, 0 when unknown
+	QuotedTOS     *int            // TOS of the probe quoted in an ICMP error
+	Hop           HopInfo         // HopUpdated only
+	Snapshot      *TraceResult    // Snapshot only, see Config.SnapshotInterval
+}
+
+// Observer receives the events of a trace. It is called synchronously from
+// the sender and listener goroutines, so it must be quick and must not block.
+type Observer func(Event)
+
+// ChanObserver returns an Observer that forwards events to ch. Events are
+// dropped while ch is full so that a slow reader never stalls the trace.
+func ChanObserver(ch chan<- Event) Observer {
+	return func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (t *TraceRoute) emit(e Event) {
+	if t.Observer != nil {
+		t.Observer(e)
+	}
+}
+
+// probeExpired records a probe that left the flow cache without a reply.
+func (t *TraceRoute) probeExpired(key, value interface{}) {
+	v, ok := value.(*SendMetric)
+	if !ok {
+		return
+	}
+	if server := t.server(v.TTL); server != nil {
+		server.Lock.Lock()
+		server.lost(v.FlowKey)
+		t.addSample(server, ProbeSample{
+			ID:     v.ID,
+			Flow:   v.FlowKey,
+			Cycle:  v.Cycle,
+			SentAt: v.TimeStamp,
+		})
+		server.Lock.Unlock()
+	}
+	t.emit(Event{
+		Type:    ProbeTimedOut,
+		Time:    time.Now(),
+		FlowKey: v.FlowKey,
+		ID:      v.ID,
+		TTL:     int(v.TTL),
+	})
+}
+
+// expirePending reports every probe still waiting for a reply as timed out.
+// A continuous trace is stopped at any time, so the probes it sent less than
+// Timeout ago are dropped without counting as lost.
+func (t *TraceRoute) expirePending() {
+	now := time.Now()
+	t.DB.Range(func(_, tdb interface{}) bool {
+		cache := tdb.(*StatsDB).Cache
+		cache.Data.Range(func(k, _ interface{}) bool {
+			v, loaded := cache.LoadAndDelete(k)
+			if !loaded {
+				return true
+			}
+			if m, ok := v.(*SendMetric); ok && t.Continuous && now.Sub(m.TimeStamp) < t.Timeout {
+				return true
+			}
+			t.probeExpired(k, v)
+			return true
+		})
+		return true
+	})
+}
+
+// destinationReached emits DestinationReached the first time the destination
+// answers.
+func (t *TraceRoute) destinationReached(e Event) {
+	if atomic.CompareAndSwapInt32(&t.destReached, 0, 1) {
+		e.Type = DestinationReached
+		t.emit(e)
+	}
+}
@@ -2,11 +2,10 @@ package ztrace
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv6"
 	"net"
-	"strings"
 	"sync/atomic"
 	"time"
 
@@ -20,16 +19,16 @@ const (
 )
 
 func (t *TraceRoute) SendIPv4ICMP() error {
-	key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, 1)
-	db := NewStatsDB(key)
+	key := t.icmpFlowKey()
+	db := t.newFlow(key)
 
-	t.DB.Store(key, db)
-	go db.Cache.Run()
-
-	conn, err := icmp.ListenPacket(ipv4Proto[t.PingType], t.NetSrcAddr.String())
+	conn, err := t.transport().ListenPacket(ipv4Proto[t.PingType], t.NetSrcAddr.String())
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
+	t.closeOnDone(conn)
+
 	ipaddr, err := net.ResolveIPAddr("ip4", t.NetDstAddr.String())
 	if err != nil {
 		return err
@@ -43,15 +42,28 @@ func (t *TraceRoute) SendIPv4ICMP() error {
 		}
 	}
 
-	t.StartTime = time.Now()
+	t.markStart()
 	mod := uint16(1 << 15)
-	for snt := 0; snt < t.Count; snt++ {
-		id := uint16(1)
-		for ttl := 1; ttl <= t.MaxTTL; ttl++ {
+	// IDs keep counting across rounds so that every probe has its own
+	// entry in the flow cache.
+	id := uint16(1)
+	for snt := 0; t.moreCycles(snt, t.Count); snt++ {
+		t.startCycle(snt)
+		for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+			if t.skip(key, snt, ttl) {
+				continue
+			}
+			if !t.pace() {
+				return nil
+			}
 			data := make([]byte, packageSize)
 			data = append(data, bytes.Repeat([]byte{1}, packageSize)...)
+			echoID := id
+			if t.Paris {
+				echoID = parisEchoID(snt, id)
+			}
 			body := &icmp.Echo{
-				ID:   int(id),
+				ID:   int(echoID),
 				Seq:  int(id),
 				Data: data,
 			}
@@ -64,42 +76,91 @@ func (t *TraceRoute) SendIPv4ICMP() error {
 			if err != nil {
 				return err
 			}
-			err = conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
-			if err != nil {
-				return fmt.Errorf("SetControlMessage()，%s", err)
-			}
-			if err = conn.IPv4PacketConn().SetTTL(ttl); err != nil {
-				return fmt.Errorf("conn.IPv4PacketConn().SetTTL()失败，%s", err)
-			}
-			_, err = conn.WriteTo(msgBytes, addr)
-			if err != nil {
-				return fmt.Errorf("conn.WriteTo()失败，%s", err)
-			}
 			m := &SendMetric{
 				FlowKey:   key,
 				ID:        uint32(id),
 				TTL:       uint8(ttl),
 				TimeStamp: time.Now(),
+				Cycle:     snt,
 			}
+			// 先记下再发，回复可能比RecordSend先到
 			atomic.AddUint64(db.SendCnt, 1)
 			id = (id + 1) % mod
 			t.RecordSend(m)
+			_, err = conn.WriteTo(msgBytes, &ControlMessage{TTL: ttl, TOS: t.TOS}, addr)
+			if err != nil {
+				if t.stopped() {
+					return nil
+				}
+				return fmt.Errorf("conn.WriteTo()失败，%s", err)
+			}
 		}
 		// 100ms
-		time.Sleep(t.Interval)
+		if !t.sleep(t.Interval) {
+			return nil
+		}
 	}
 	return nil
 }
 
+// parisEchoID returns the echo ID that keeps the checksum of every echo
+// request of a round the same: ID and seq always add up to 0x8000+round, and
+// each round gets its own checksum and so its own path.
+func parisEchoID(round int, seq uint16) uint16 {
+	return uint16(0x8000+round) - seq
+}
+
+// echoOurs reports whether the echo reply echo carries the ID its probe was
+// sent with, so that replies to other pings with the same Seq are dropped.
+// Unprivileged sockets rewrite the ID and deliver only their own replies, so
+// it is checked on raw sockets only.
+func (t *TraceRoute) echoOurs(echo *icmp.Echo) bool {
+	if t.PingType != "icmp" {
+		return true
+	}
+	want := uint16(echo.Seq)
+	if t.Paris {
+		tdb, ok := t.DB.Load(t.icmpFlowKey())
+		if !ok {
+			return false
+		}
+		v, ok := tdb.(*StatsDB).Cache.Load(uint32(echo.Seq))
+		if !ok {
+			return false
+		}
+		want = parisEchoID(v.(*SendMetric).Cycle, uint16(echo.Seq))
+	}
+	return echo.ID == int(want)
+}
+
+// ListenIPv4ICMP receives the ICMP replies of ICMP, UDP and TCP traces. Echo
+// replies go to the ICMP flow; Time Exceeded and Destination Unreachable go
+// to the flow of the probe they quote, by its IPv4 and transport headers.
 func (t *TraceRoute) ListenIPv4ICMP() error {
-	conn, err := icmp.ListenPacket(ipv4Proto[t.PingType], t.NetSrcAddr.String())
+	conn, err := t.listenIPv4ICMP()
 	if err != nil {
 		return err
 	}
-	//err = conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
-	//if err != nil {
-	//	return fmt.Errorf("SetControlMessage()，%s", err)
-	//}
+	return t.recvIPv4ICMP(conn)
+}
+
+// listenIPv4ICMP opens the socket of ListenIPv4ICMP.
+func (t *TraceRoute) listenIPv4ICMP() (PacketConn, error) {
+	network := ipv4Proto[t.PingType]
+	if t.Protocol != "icmp" {
+		network = "ip4:icmp"
+	}
+	conn, err := t.transport().ListenPacket(network, t.NetSrcAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	t.closeOnDone(conn)
+	return conn, nil
+}
+
+// recvIPv4ICMP is the receive loop of ListenIPv4ICMP; it closes conn.
+func (t *TraceRoute) recvIPv4ICMP(conn PacketConn) error {
+	defer conn.Close()
 	for {
 		// 包+头
 		buf := make([]byte, 1500)
@@ -108,8 +169,12 @@ func (t *TraceRoute) ListenIPv4ICMP() error {
 		}
 		// tmd，在苹果手机(底层是ios)上这个ReadFrom会阻塞读，在ios模拟器(底层是dawrin)上就没事
 		// md，怎么在android又是另一个情况，不仅阻塞住了，而且一直读不到东西
-		n, _, src, err := conn.IPv4PacketConn().ReadFrom(buf)
+		n, cm, src, err := conn.ReadFrom(buf)
 		if err != nil {
+			if t.stopped() {
+				t.Statistics()
+				break
+			}
 			if neterr, ok := err.(*net.OpError); ok {
 				if neterr.Timeout() {
 					if t.IsFinish() {
@@ -123,71 +188,88 @@ func (t *TraceRoute) ListenIPv4ICMP() error {
 			}
 			return err
 		}
-		// 结果如8.8.8.8:0
-		respAddr := src.String()
-		splitSrc := strings.Split(respAddr, ":")
-		if len(splitSrc) == 2 {
-			respAddr = splitSrc[0]
-		}
-		x, err := icmp.ParseMessage(protocolICMP, buf)
+		x, err := icmp.ParseMessage(protocolICMP, buf[:n])
 		if err != nil {
-			return fmt.Errorf("error parsing icmp message: %w", err)
+			continue
 		}
-		key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, 1)
-		// 超时
-		if x.Type == ipv4.ICMPTypeTimeExceeded || x.Type == ipv6.ICMPTypeTimeExceeded {
-			switch pkt := x.Body.(type) {
-			case *icmp.TimeExceeded:
-				// 设置ttl后，一定会返回这个超时内容，头部长度是20，因此从20之后开始解析
-				m, err := icmp.ParseMessage(protocolICMP, pkt.Data[20:])
-				if err != nil {
-					return err
-				}
-				switch p := m.Body.(type) {
-				case *icmp.Echo:
-					recv := &RecvMetric{
-						FlowKey:   key,
-						ID:        uint32(p.ID),
-						RespAddr:  respAddr,
-						TimeStamp: time.Now(),
-					}
-					t.RecordRecv(recv)
-					// 取最大的一跳，+1是为了把最后一跳到达目的ip的那一跳算上
-					//if p.ID+1 > t.LastHop {
-					//	t.LastHop = p.ID + 1
-					//}
-				default:
-					return fmt.Errorf("invalid ICMP time exceeded and echo reply; type: '%T', '%v'", pkt, pkt)
-				}
-			default:
-				return fmt.Errorf("invalid ICMP time exceeded; type: '%T', '%v'", pkt, pkt)
+		var key string
+		var id uint32
+		var mtu int
+		var tos *int
+		switch pkt := x.Body.(type) {
+		case *icmp.TimeExceeded:
+			key, id = t.quotedProbe4(pkt.Data)
+			tos = quotedTOS(pkt.Data)
+		case *icmp.DstUnreach:
+			key, id = t.quotedProbe4(pkt.Data)
+			tos = quotedTOS(pkt.Data)
+			// Fragmentation Needed带着下一跳的MTU
+			if x.Code == 4 {
+				mtu = int(binary.BigEndian.Uint16(buf[6:8]))
 			}
-		}
-		// 收到echo reply，证明到达目的ip
-		if x.Type == ipv4.ICMPTypeEchoReply || x.Type == ipv6.ICMPTypeEchoReply {
-			// echo reply的时候，返回的包不可能比发的包小
-			if n < packageSize {
+		case *icmp.ParamProb:
+			key, id = t.quotedProbe4(pkt.Data)
+			tos = quotedTOS(pkt.Data)
+		case *icmp.Echo:
+			// 收到echo reply，证明到达目的ip；echo reply的时候，返回的包不可能比发的包小
+			if x.Type != ipv4.ICMPTypeEchoReply || n < packageSize || addrIP(src) != t.NetDstAddr.String() || !t.echoOurs(pkt) {
 				continue
 			}
-			switch pkt := x.Body.(type) {
-			// 只有到达目的ip，是echo
-			case *icmp.Echo:
-				//msg := x.Body.(*icmp.Echo)
-				m := &RecvMetric{
-					FlowKey:   key,
-					ID:        uint32(pkt.ID),
-					RespAddr:  respAddr,
-					TimeStamp: time.Now(),
-				}
-				t.RecordRecv(m)
-				// 因为当ttl到一定值时，后面都是能到达目的ip，所以要筛选出最小的跳数，即最后一跳
-				//if pkt.ID < t.LastHop {
-				//	t.LastHop = pkt.ID
-				//}
-			default:
-				return fmt.Errorf("invalid ICMP echo reply; type: '%T', '%v'", pkt, pkt)
-			}
+			key, id = t.icmpFlowKey(), uint32(pkt.Seq)
+		}
+		if key == "" {
+			continue
 		}
+		t.RecordRecv(&RecvMetric{
+			FlowKey:       key,
+			ID:            id,
+			RespAddr:      addrIP(src),
+			TimeStamp:     time.Now(),
+			ReplyTTL:      replyTTL(cm),
+			ICMPType:      int(x.Type.(ipv4.ICMPType)),
+			ICMPCode:      x.Code,
+			MTU:           mtu,
+			QuotedTOS:     tos,
+			MPLS:          mplsLabels(x.Body),
+			InterfaceInfo: interfaceInfo(x.Body),
+		})
 	}
 	return nil
 }
+
+// quotedProbe4 returns the flow key and probe ID of the IPv4 packet quoted in
+// an ICMP error, or an empty key when it is not a probe to the destination.
+// UDP probes are identified by the IP ID, or the UDP checksum in Paris mode,
+// TCP probes by the sequence number
+// and ICMP probes by the echo sequence, which unlike the echo ID is kept by
+// unprivileged ICMP sockets.
+func (t *TraceRoute) quotedProbe4(b []byte) (string, uint32) {
+	if len(b) < ipv4.HeaderLen || b[0]>>4 != ipv4.Version {
+		return "", 0
+	}
+	hlen := int(b[0]&0x0f) << 2
+	dst := net.IP(b[16:20])
+	if hlen < ipv4.HeaderLen || len(b) < hlen+8 || !dst.Equal(t.NetDstAddr) {
+		return "", 0
+	}
+	src := net.IP(b[12:16])
+	l4 := b[hlen:]
+	srcPort := binary.BigEndian.Uint16(l4[0:2])
+	dstPort := binary.BigEndian.Uint16(l4[2:4])
+	switch b[9] {
+	case protocolICMP:
+		if l4[0] != byte(ipv4.ICMPTypeEcho) {
+			return "", 0
+		}
+		return t.icmpFlowKey(), uint32(binary.BigEndian.Uint16(l4[6:8]))
+	case 17:
+		id := binary.BigEndian.Uint16(b[4:6])
+		if t.Paris {
+			id = binary.BigEndian.Uint16(l4[6:8])
+		}
+		return GetHash(src, dst, srcPort, dstPort, 17), uint32(id)
+	case 6:
+		return GetHash(src, dst, srcPort, dstPort, 6), binary.BigEndian.Uint32(l4[4:8])
+	}
+	return "", 0
+}
@@ -0,0 +1,85 @@
+package ztrace
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/icmp"
+)
+
+// InterfaceRole is the interface of the hop an RFC 5837 interface
+// information object describes.
+type InterfaceRole string
+
+const (
+	InterfaceIncoming InterfaceRole = "incoming" // the interface the probe arrived on
+	InterfaceSubIP    InterfaceRole = "sub-ip"   // a sub-IP component of the incoming interface
+	InterfaceOutgoing InterfaceRole = "outgoing" // the interface the probe would have left on
+	InterfaceNextHop  InterfaceRole = "next-hop" // the next hop the probe would have been sent to
+)
+
+// interfaceRoles are the roles in the order of their C-Type bits.
+var interfaceRoles = []InterfaceRole{InterfaceIncoming, InterfaceSubIP, InterfaceOutgoing, InterfaceNextHop}
+
+// InterfaceInfo is an RFC 5837 interface information object quoted by a hop
+// in the extensions of its ICMP error. Fields the hop left out are zero.
+type InterfaceInfo struct {
+	Role    InterfaceRole `json:"role"`
+	IfIndex int           `json:"ifindex,omitempty"`
+	Addr    string        `json:"addr,omitempty"`
+	Name    string        `json:"name,omitempty"`
+	MTU     int           `json:"mtu,omitempty"`
+}
+
+// String formats the object in the style of the MPLS labels of traceroute -e,
+// e.g. <IN:ae3.0,ifindex=12,addr=10.1.1.1,mtu=9000>.
+func (i InterfaceInfo) String() string {
+	var role string
+	switch i.Role {
+	case InterfaceIncoming:
+		role = "IN"
+	case InterfaceSubIP:
+		role = "SUB"
+	case InterfaceOutgoing:
+		role = "OUT"
+	case InterfaceNextHop:
+		role = "NH"
+	}
+	var fields []string
+	if i.Name != "" {
+		fields = append(fields, i.Name)
+	}
+	if i.IfIndex > 0 {
+		fields = append(fields, fmt.Sprintf("ifindex=%d", i.IfIndex))
+	}
+	if i.Addr != "" {
+		fields = append(fields, "addr="+i.Addr)
+	}
+	if i.MTU > 0 {
+		fields = append(fields, fmt.Sprintf("mtu=%d", i.MTU))
+	}
+	return "<" + role + ":" + strings.Join(fields, ",") + ">"
+}
+
+// interfaceInfo returns the interface information objects carried in the
+// extensions of an ICMP error. The two high bits of the C-Type give the role.
+func interfaceInfo(body icmp.MessageBody) []InterfaceInfo {
+	var infos []InterfaceInfo
+	for _, ext := range extensions(body) {
+		ifi, ok := ext.(*icmp.InterfaceInfo)
+		if !ok {
+			continue
+		}
+		info := InterfaceInfo{Role: interfaceRoles[ifi.Type>>6&3]}
+		if ifi.Interface != nil {
+			info.IfIndex = ifi.Interface.Index
+			info.Name = ifi.Interface.Name
+			info.MTU = ifi.Interface.MTU
+		}
+		if ifi.Addr != nil && ifi.Addr.IP != nil {
+			info.Addr = ifi.Addr.IP.String()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -1,10 +1,13 @@
 package ztrace
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"net"
-	"runtime"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -12,123 +15,511 @@ import (
 	"golang.org/x/net/ipv6"
 )
 
+// TraceIpv6ICMP traces with ICMPv6 echo probes, sending and listening
+// concurrently the same way TraceICMP does for IPv4.
 func (t *TraceRoute) TraceIpv6ICMP() (err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			logrus.Error(e)
-			buf := make([]byte, 64<<10)
-			buf = buf[:runtime.Stack(buf, false)]
-			err = fmt.Errorf("errgroup: panic recovered: %s\n %s", e, buf)
-		}
-	}()
-
-	var dst net.IPAddr
+	var handlers []func() error
 
-	if _, err := t.dnsResolve(t.Dest, &dst); err != nil {
-		logrus.Error("TraceIpv6ICMP failed:", err)
+	conn, err := t.listenIPv6ICMP()
+	if err != nil {
 		return err
 	}
+	handlers = append(handlers, func() error {
+		return t.recvIPv6ICMP(conn)
+	})
+
+	handlers = append(handlers, func() error {
+		return t.SendIPv6ICMP()
+	})
 
-	icmp6Sock, err := net.ListenPacket("ip6:ipv6-icmp", t.SrcAddr)
+	return GoroutineNotPanic(handlers...)
+}
+
+func (t *TraceRoute) SendIPv6ICMP() error {
+	key := t.icmpFlowKey()
+	db := t.newFlow(key)
+
+	conn, err := t.transport().ListenPacket(ipv6Proto[t.PingType], t.SrcAddr)
 	if err != nil {
-		logrus.Error("Could not set a listening ICMP6 socket: ", err)
 		return err
 	}
-	defer icmp6Sock.Close()
+	defer conn.Close()
+	t.closeOnDone(conn)
 
-	ipv6Sock := ipv6.NewPacketConn(icmp6Sock)
-	defer ipv6Sock.Close()
+	var addr net.Addr = &net.IPAddr{IP: t.NetDstAddr}
+	if t.PingType == "udp" {
+		addr = &net.UDPAddr{IP: t.NetDstAddr}
+	}
 
-	if err := ipv6Sock.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagDst|ipv6.FlagInterface|ipv6.FlagSrc, true); err != nil {
-		logrus.Error("Could not set options on the ipv6 socket: ", err)
+	t.markStart()
+	mod := uint16(1 << 15)
+	seq := uint16(1)
+	for snt := 0; t.moreCycles(snt, t.Count); snt++ {
+		t.startCycle(snt)
+		for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+			if t.skip(key, snt, ttl) {
+				continue
+			}
+			if !t.pace() {
+				return nil
+			}
+			echoID := seq
+			if t.Paris {
+				echoID = parisEchoID(snt, seq)
+			}
+			msg := &icmp.Message{
+				Type: ipv6.ICMPTypeEchoRequest,
+				Code: 0,
+				Body: &icmp.Echo{
+					ID:   int(echoID),
+					Seq:  int(seq),
+					Data: bytes.Repeat([]byte{1}, packageSize),
+				},
+			}
+			// The kernel fills in the ICMPv6 checksum.
+			msgBytes, err := msg.Marshal(nil)
+			if err != nil {
+				return err
+			}
+			m := &SendMetric{
+				FlowKey:   key,
+				ID:        uint32(seq),
+				TTL:       uint8(ttl),
+				TimeStamp: time.Now(),
+				Cycle:     snt,
+			}
+			// 先记下再发，回复可能比RecordSend先到
+			atomic.AddUint64(db.SendCnt, 1)
+			seq = (seq + 1) % mod
+			t.RecordSend(m)
+			if _, err := conn.WriteTo(msgBytes, &ControlMessage{TTL: ttl, TOS: t.TOS}, addr); err != nil {
+				if t.stopped() {
+					return nil
+				}
+				return fmt.Errorf("conn.WriteTo()失败，%s", err)
+			}
+		}
+		if !t.sleep(t.Interval) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ListenIPv6ICMP receives the ICMPv6 replies of ICMP, UDP and TCP traces
+// like ListenIPv4ICMP: echo replies go to the ICMP flow, errors go to the
+// flow of the probe they quote.
+func (t *TraceRoute) ListenIPv6ICMP() error {
+	conn, err := t.listenIPv6ICMP()
+	if err != nil {
 		return err
 	}
+	return t.recvIPv6ICMP(conn)
+}
 
-	icmp6Echo := icmp.Message{
-		Type: ipv6.ICMPTypeEchoRequest, Code: 0, Body: &icmp.Echo{ID: rand.Int(), Data: []byte("")},
+// listenIPv6ICMP opens the socket of ListenIPv6ICMP.
+func (t *TraceRoute) listenIPv6ICMP() (PacketConn, error) {
+	network := ipv6Proto[t.PingType]
+	if t.Protocol != "icmp" {
+		network = "ip6:ipv6-icmp"
+	}
+	conn, err := t.transport().ListenPacket(network, t.SrcAddr)
+	if err != nil {
+		logrus.Error("bind failure:", err)
+		return nil, err
 	}
+	t.closeOnDone(conn)
+	return conn, nil
+}
 
+// recvIPv6ICMP is the receive loop of ListenIPv6ICMP; it closes conn.
+func (t *TraceRoute) recvIPv6ICMP(conn PacketConn) error {
+	defer conn.Close()
 	buf := make([]byte, 1500)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200)); err != nil {
+			return err
+		}
+		n, cm, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			if t.stopped() {
+				t.Statistics()
+				break
+			}
+			if neterr, ok := err.(*net.OpError); ok && neterr.Timeout() {
+				if t.IsFinish() {
+					t.Statistics()
+					break
+				}
+				continue
+			}
+			return err
+		}
 
-	isDest := false
-	for i := 1; i <= int(t.MaxTTL); i++ {
+		x, err := icmp.ParseMessage(protocolIPv6ICMP, buf[:n])
+		if err != nil {
+			continue
+		}
+		var key string
+		var id uint32
+		var mtu int
+		var tos *int
+		switch pkt := x.Body.(type) {
+		case *icmp.TimeExceeded:
+			key, id = t.quotedProbe6(pkt.Data)
+			tos = quotedTOS(pkt.Data)
+		case *icmp.DstUnreach:
+			key, id = t.quotedProbe6(pkt.Data)
+			tos = quotedTOS(pkt.Data)
+		case *icmp.PacketTooBig:
+			key, id = t.quotedProbe6(pkt.Data)
+			tos = quotedTOS(pkt.Data)
+			mtu = pkt.MTU
+		case *icmp.ParamProb:
+			key, id = t.quotedProbe6(pkt.Data)
+			tos = quotedTOS(pkt.Data)
+		case *icmp.Echo:
+			// Unprivileged ICMP sockets rewrite the echo ID, so replies are
+			// matched by Seq; echoOurs checks the ID on raw sockets.
+			if x.Type != ipv6.ICMPTypeEchoReply || addrIP(src) != t.NetDstAddr.String() || !t.echoOurs(pkt) {
+				continue
+			}
+			key, id = t.icmpFlowKey(), uint32(pkt.Seq)
+		}
+		if key == "" {
+			continue
+		}
+		t.RecordRecv(&RecvMetric{
+			FlowKey:       key,
+			ID:            id,
+			RespAddr:      addrIP(src),
+			TimeStamp:     time.Now(),
+			ReplyTTL:      replyTTL(cm),
+			ICMPType:      int(x.Type.(ipv6.ICMPType)),
+			ICMPCode:      x.Code,
+			MTU:           mtu,
+			QuotedTOS:     tos,
+			MPLS:          mplsLabels(x.Body),
+			InterfaceInfo: interfaceInfo(x.Body),
+		})
+	}
+	return nil
+}
 
-		hopData := HopData{
-			Hop: i,
+// quotedProbe6 returns the flow key and probe ID of the IPv6 packet quoted
+// in an ICMPv6 error, or an empty key when it is not a probe to the
+// destination. UDP probes are identified by the first two payload bytes, or
+// the UDP checksum in Paris mode, TCP probes by the sequence number and echo
+// probes by the echo sequence, like quotedProbe4 does.
+func (t *TraceRoute) quotedProbe6(b []byte) (string, uint32) {
+	iph, err := ipv6.ParseHeader(b)
+	if err != nil || !iph.Dst.Equal(t.NetDstAddr) || len(b) < ipv6.HeaderLen+8 {
+		return "", 0
+	}
+	l4 := b[ipv6.HeaderLen:]
+	src, dst := iph.Src.To16(), iph.Dst.To16()
+	srcPort := binary.BigEndian.Uint16(l4[0:2])
+	dstPort := binary.BigEndian.Uint16(l4[2:4])
+	switch iph.NextHeader {
+	case protocolIPv6ICMP:
+		if l4[0] != byte(ipv6.ICMPTypeEchoRequest) {
+			return "", 0
+		}
+		return t.icmpFlowKey(), uint32(binary.BigEndian.Uint16(l4[6:8]))
+	case 17:
+		if len(l4) < 10 {
+			return "", 0
 		}
+		id := binary.BigEndian.Uint16(l4[8:10])
+		if t.Paris {
+			id = binary.BigEndian.Uint16(l4[6:8])
+		}
+		return GetHash(src, dst, srcPort, dstPort, 17), uint32(id)
+	case 6:
+		return GetHash(src, dst, srcPort, dstPort, 6), binary.BigEndian.Uint32(l4[4:8])
+	}
+	return "", 0
+}
 
-		for j := 0; j < t.Count; j++ {
+// TraceIpv6UDP traces with UDP probes to the high ports, one flow per Count
+// like TraceUDP.
+func (t *TraceRoute) TraceIpv6UDP() (err error) {
+	var handlers []func() error
 
-			icmp6Echo.Body.(*icmp.Echo).Seq = i
+	conn, err := t.listenIPv6ICMP()
+	if err != nil {
+		return err
+	}
+	handlers = append(handlers, func() error {
+		return t.recvIPv6ICMP(conn)
+	})
+
+	t.markStart()
+	for i := 0; i < t.Count; i++ {
+		handlers = append(handlers, func() error {
+			return t.SendIPv6UDP()
+		})
+	}
 
-			buffer, err := icmp6Echo.Marshal(nil)
+	return GoroutineNotPanic(handlers...)
+}
 
-			if err != nil {
-				logrus.Error("Could not serialize the ICMP6 echo request: ", err)
-				return err
-			}
+func (t *TraceRoute) SendIPv6UDP() error {
+	dport := uint16(33434 + rand.Int31n(64))
+	sport, key, db := t.newPortFlow(17, dport)
 
-			if err := ipv6Sock.SetHopLimit(i); err != nil {
-				logrus.Error("Could not set the HopLimit field: ", err)
-				return err
-			}
+	conn, err := t.transport().ListenPacket("ip6:udp", t.SrcAddr)
+	if err != nil {
+		logrus.Error("can not create raw socket:", err)
+		return err
+	}
+	defer conn.Close()
+	t.closeOnDone(conn)
 
-			timeNow := time.Now()
+	dst := &net.IPAddr{IP: t.NetDstAddr}
+	id := uint16(1)
+	mod := uint16(1 << 15)
 
-			if _, err := ipv6Sock.WriteTo(buffer, nil, &dst); err != nil {
-				logrus.Error("Could not send the ICMP6 echo packet: ", err)
-				return err
+	for cycle := 0; t.moreCycles(cycle, 1); cycle++ {
+		if cycle > 0 && !t.sleep(t.Interval) {
+			return nil
+		}
+		t.startCycle(cycle)
+		for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+			if t.skip(key, cycle, ttl) {
+				continue
 			}
-
-			if err := ipv6Sock.SetReadDeadline(time.Now().Add(t.Timeout)); err != nil {
-				logrus.Error("Could not set the read timeout on the ipv6 socket: ", err)
-				return err
+			if !t.pace() {
+				return nil
+			}
+			pkt := t.BuildIPv6UDPkt(sport, dport, id)
+			m := &SendMetric{
+				FlowKey:   key,
+				ID:        uint32(id),
+				TTL:       uint8(ttl),
+				TimeStamp: time.Now(),
+				Cycle:     cycle,
+			}
+			// Paris模式下ID放在校验和里，而校验和不会是0
+			if id = (id + 1) % mod; id == 0 {
+				id = 1
 			}
+			// 先记下再发，回复可能比RecordSend先到
+			atomic.AddUint64(db.SendCnt, 1)
+			t.RecordSend(m)
+			if _, err := conn.WriteTo(pkt, &ControlMessage{TTL: ttl, TOS: t.TOS}, dst); err != nil {
+				if t.stopped() {
+					return nil
+				}
+				return fmt.Errorf("conn.WriteTo()失败，%s", err)
+			}
+		}
+	}
 
-			n, _, node, err := ipv6Sock.ReadFrom(buf)
+	return nil
+}
 
-			hop := map[string]interface{}{}
-			if err == nil {
-				answer, err := icmp.ParseMessage(58, buf[:n])
+// TraceIpv6TCP traces with TCP SYN probes to TCPDPort, or every port of
+// TCPProbePorts in multi-port mode, one flow per Count like TraceTCP.
+func (t *TraceRoute) TraceIpv6TCP() (err error) {
+	var handlers []func() error
 
-				if err != nil {
-					logrus.Error("Could not parse the ICMP6 packet from: ", node.String())
-					return err
-				}
+	conn, err := t.listenIPv6ICMP()
+	if err != nil {
+		return err
+	}
+	tcpConn, err := t.listenIPv6TCP()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	handlers = append(handlers, func() error {
+		return t.recvIPv6ICMP(conn)
+	})
+	handlers = append(handlers, func() error {
+		return t.recvIPv6TCP(tcpConn)
+	})
+
+	t.markStart()
+	for _, port := range t.probePorts() {
+		port := port
+		for i := 0; i < t.Count; i++ {
+			handlers = append(handlers, func() error {
+				return t.sendIPv6TCP(port)
+			})
+		}
+	}
 
-				timeCost := time.Since(timeNow)
+	return GoroutineNotPanic(handlers...)
+}
 
-				if answer.Type == ipv6.ICMPTypeTimeExceeded {
+func (t *TraceRoute) SendIPv6TCP() error {
+	return t.sendIPv6TCP(t.TCPDPort)
+}
 
-					hop = map[string]interface{}{
-						"rtt":   fmt.Sprintf("%s", timeCost),
-						"saddr": node.String(),
-					}
+func (t *TraceRoute) sendIPv6TCP(dport uint16) error {
+	sport, key, db := t.newPortFlow(6, dport)
+	t.flowPorts.Store(key, dport)
 
-					hopData.Details = append(hopData.Details, hop)
-				} else if answer.Type == ipv6.ICMPTypeEchoReply {
-					hop = map[string]interface{}{
-						"rtt":   fmt.Sprintf("%s", timeCost),
-						"saddr": node.String(),
-					}
-					hopData.Details = append(hopData.Details, hop)
+	conn, err := t.transport().ListenPacket("ip6:tcp", t.SrcAddr)
+	if err != nil {
+		logrus.Error("can not create raw socket:", err)
+		return err
+	}
+	defer conn.Close()
+	t.closeOnDone(conn)
 
-					t.LastArrived += 1
-					if t.LastArrived == t.Count {
-						isDest = true
-						break
-					}
+	dst := &net.IPAddr{IP: t.NetDstAddr}
+	seq := uint32(1000)
+	mod := uint32(1 << 30)
 
+	for cycle := 0; t.moreCycles(cycle, 1); cycle++ {
+		if cycle > 0 && !t.sleep(t.Interval) {
+			return nil
+		}
+		t.startCycle(cycle)
+		for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+			if t.skip(key, cycle, ttl) {
+				continue
+			}
+			if !t.pace() {
+				return nil
+			}
+			pkt := t.BuildIPv6TCPSYN(sport, dport, seq)
+			m := &SendMetric{
+				FlowKey:   key,
+				ID:        seq,
+				TTL:       uint8(ttl),
+				TimeStamp: time.Now(),
+				Cycle:     cycle,
+			}
+			seq = (seq + 4) % mod
+			// 先记下再发，回复可能比RecordSend先到
+			atomic.AddUint64(db.SendCnt, 1)
+			t.RecordSend(m)
+			if _, err := conn.WriteTo(pkt, &ControlMessage{TTL: ttl, TOS: t.TOS}, dst); err != nil {
+				if t.stopped() {
+					return nil
 				}
+				return fmt.Errorf("conn.WriteTo()失败，%s", err)
 			}
 		}
+	}
 
-		t.Hops = append(t.Hops, hopData)
+	return nil
+}
 
-		if isDest {
-			break
-		}
+// ListenIPv6TCP matches the SYN-ACK or RST of the destination to the SYN it
+// acknowledges, and resets the half-open connections of SYN-ACKs. IPv6 raw
+// sockets deliver the segment without the IP header.
+func (t *TraceRoute) ListenIPv6TCP() error {
+	conn, err := t.listenIPv6TCP()
+	if err != nil {
+		return err
+	}
+	return t.recvIPv6TCP(conn)
+}
+
+// listenIPv6TCP opens the socket of ListenIPv6TCP, which also sends the RSTs.
+func (t *TraceRoute) listenIPv6TCP() (PacketConn, error) {
+	conn, err := t.transport().ListenPacket("ip6:tcp", t.SrcAddr)
+	if err != nil {
+		logrus.Error("bind failure:", err)
+		return nil, err
 	}
+	t.closeOnDone(conn)
+	return conn, nil
+}
+
+// recvIPv6TCP is the receive loop of ListenIPv6TCP; it closes conn.
+func (t *TraceRoute) recvIPv6TCP(conn PacketConn) error {
+	defer conn.Close()
+	buf := make([]byte, 1500)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200)); err != nil {
+			return err
+		}
+		n, cm, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			if t.stopped() {
+				break
+			}
+			if neterr, ok := err.(*net.OpError); ok && neterr.Timeout() {
+				if t.IsFinish() {
+					break
+				}
+				continue
+			}
+			return err
+		}
 
+		if n < 20 || addrIP(src) != t.NetDstAddr.String() {
+			continue
+		}
+		srcPort := binary.BigEndian.Uint16(buf[0:2])
+		dstPort := binary.BigEndian.Uint16(buf[2:4])
+		ack := binary.BigEndian.Uint32(buf[8:12])
+		flags := buf[13]
+		state, ok := tcpState(flags)
+		key := GetHash(t.NetSrcAddr.To16(), t.NetDstAddr.To16(), dstPort, srcPort, 6)
+		if !ok || !t.tcpFlow(key) {
+			continue
+		}
+		// 只处理回复我们探测的报文，别的连接不能被重置
+		if !t.RecordRecv(&RecvMetric{
+			FlowKey:   key,
+			ID:        ack - 1,
+			RespAddr:  t.NetDstAddr.String(),
+			TimeStamp: time.Now(),
+			ReplyTTL:  replyTTL(cm),
+		}) {
+			continue
+		}
+		t.recordTCPPort(srcPort, state)
+		if state == TCPPortOpen {
+			rst := t.BuildIPv6TCPRST(dstPort, srcPort, ack)
+			if _, err := conn.WriteTo(rst, &ControlMessage{TTL: 64}, src); err != nil {
+				logrus.Error("send RST failed:", err)
+			}
+		}
+	}
 	return nil
 }
+
+// hopData converts the recorded IPv6 replies to the Hops layout used before
+// IPv6 traces filled Metric.
+func (t *TraceRoute) hopData() []HopData {
+	hops := make([]HopData, 0, t.LastHop)
+	for ttl := t.firstTTL(); ttl <= t.LastHop && ttl < len(t.Metric); ttl++ {
+		server := t.Metric[ttl]
+		hop := HopData{Hop: ttl}
+		server.Lock.Lock()
+		for _, s := range server.Samples {
+			if !s.Received {
+				continue
+			}
+			hop.Details = append(hop.Details, map[string]interface{}{
+				"rtt":   fmt.Sprintf("%s", time.Duration(s.RTTMs*float64(time.Millisecond))),
+				"saddr": s.Responder,
+			})
+		}
+		server.Lock.Unlock()
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// addrIP returns the IP of a reply source without the port or zone.
+func addrIP(a net.Addr) string {
+	switch v := a.(type) {
+	case *net.IPAddr:
+		return v.IP.String()
+	case *net.UDPAddr:
+		return v.IP.String()
+	}
+	host := a.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.SplitN(host, "%", 2)[0]
+}
@@ -0,0 +1,296 @@
+package ztrace
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mdaMaxFlows bounds the flows MDA sends per TTL. It covers the 95% stopping
+// point of 32 next hops.
+const mdaMaxFlows = 256
+
+// mdaStoppingPoint returns n_k, the number of flows that rule out one more
+// next hop than the k already seen with probability confidence:
+// n_k = ceil(ln(α/(k+1)) / ln(k/(k+1))) with α = 1 - confidence.
+func mdaStoppingPoint(k int, confidence float64) int {
+	alpha := 1 - confidence
+	n := math.Ceil(math.Log(alpha/float64(k+1)) / math.Log(float64(k)/float64(k+1)))
+	if n < 1 {
+		return 1
+	}
+	return int(n)
+}
+
+// mdaFlow is one flow identifier of an MDA trace: every probe of the flow
+// uses the same ports, whatever its TTL.
+type mdaFlow struct {
+	sport uint16
+	key   string
+	db    *StatsDB
+}
+
+// mdaSender sends single probes of any flow over the sockets of the trace
+// address family and protocol.
+type mdaSender struct {
+	t     *TraceRoute
+	dport uint16
+	flows []*mdaFlow
+	raw   RawConn
+	conn  PacketConn
+}
+
+// TraceMDA enumerates the load-balanced interfaces of every hop with the
+// Multipath Detection Algorithm: at each TTL it adds flows until the
+// stopping point for the interfaces seen so far is reached, then moves on.
+// Flows keep their ports across TTLs, so the hops each flow crossed give the
+// links between successive hops.
+func (t *TraceRoute) TraceMDA() (err error) {
+	var handlers []func() error
+
+	// 接收的socket要在发包之前打开
+	if t.Af == "ip6" {
+		conn, err := t.listenIPv6ICMP()
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, func() error {
+			return t.recvIPv6ICMP(conn)
+		})
+		if t.Protocol == "tcp" {
+			tcpConn, err := t.listenIPv6TCP()
+			if err != nil {
+				conn.Close()
+				return err
+			}
+			handlers = append(handlers, func() error {
+				return t.recvIPv6TCP(tcpConn)
+			})
+		}
+	} else {
+		conn, err := t.listenIPv4ICMP()
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, func() error {
+			return t.recvIPv4ICMP(conn)
+		})
+		if t.Protocol == "tcp" {
+			tcpConn, rSocket, err := t.listenIPv4TCP()
+			if err != nil {
+				conn.Close()
+				return err
+			}
+			handlers = append(handlers, func() error {
+				return t.recvIPv4TCP(tcpConn, rSocket)
+			})
+		}
+	}
+
+	t.markStart()
+
+	handlers = append(handlers, func() error {
+		defer atomic.StoreInt32(&t.senderDone, 1)
+		return t.SendMDA()
+	})
+
+	return GoroutineNotPanic(handlers...)
+}
+
+func (t *TraceRoute) SendMDA() error {
+	s := &mdaSender{t: t, dport: 33434}
+	if t.Protocol == "tcp" {
+		s.dport = t.TCPDPort
+	}
+	var err error
+	switch {
+	case t.Af == "ip6":
+		s.conn, err = t.transport().ListenPacket("ip6:"+t.Protocol, t.SrcAddr)
+	default:
+		s.raw, err = t.transport().ListenRaw("ip4:"+t.Protocol, t.NetSrcAddr.String())
+	}
+	if err != nil {
+		logrus.Error("can not create raw socket:", err)
+		return err
+	}
+	defer s.close()
+
+	silent := 0
+	for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+		sent := 0
+		for {
+			k := len(t.interfaces(ttl))
+			if k == 0 {
+				k = 1
+			}
+			need := mdaStoppingPoint(k, t.MDAConfidence)
+			if need > mdaMaxFlows {
+				need = mdaMaxFlows
+			}
+			if sent >= need {
+				break
+			}
+			first := sent
+			for ; sent < need; sent++ {
+				if !t.pace() {
+					return nil
+				}
+				if err := s.send(sent, ttl); err != nil {
+					if t.stopped() {
+						return nil
+					}
+					return err
+				}
+			}
+			if !s.wait(first, sent, ttl) {
+				return nil
+			}
+		}
+		if s.stopped(ttl) {
+			return nil
+		}
+		addrs := t.interfaces(ttl)
+		for _, addr := range addrs {
+			if addr == t.NetDstAddr.String() {
+				return nil
+			}
+		}
+		if len(addrs) > 0 {
+			silent = 0
+		} else if silent++; t.GapLimit > 0 && silent >= t.GapLimit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// stopped reports whether every flow got an Unreachable or reached the
+// destination at ttl or below.
+func (s *mdaSender) stopped(ttl int) bool {
+	for _, f := range s.flows {
+		if stop := s.t.flowLimit(f.key, 0); stop == 0 || stop > ttl {
+			return false
+		}
+	}
+	return len(s.flows) > 0
+}
+
+// send sends the probe of flow i with ttl. Each flow sends one probe per
+// TTL, so the TTL is the probe ID.
+func (s *mdaSender) send(i, ttl int) error {
+	t := s.t
+	for len(s.flows) <= i {
+		sport := uint16(1000 + int(t.PortOffset) + len(s.flows))
+		proto := uint16(17)
+		if t.Protocol == "tcp" {
+			proto = 6
+		}
+		src, dst := t.NetSrcAddr.To4(), t.NetDstAddr.To4()
+		if t.Af == "ip6" {
+			src, dst = t.NetSrcAddr.To16(), t.NetDstAddr.To16()
+		}
+		key := GetHash(src, dst, sport, s.dport, proto)
+		if proto == 6 {
+			t.flowPorts.Store(key, s.dport)
+		}
+		s.flows = append(s.flows, &mdaFlow{sport: sport, key: key, db: t.newFlow(key)})
+	}
+	f := s.flows[i]
+
+	id := uint32(ttl)
+	if t.Protocol == "tcp" {
+		id = mdaSeq(ttl)
+	}
+	// 先记下再发，回复可能比RecordSend先到
+	atomic.AddUint64(f.db.SendCnt, 1)
+	t.RecordSend(&SendMetric{
+		FlowKey:   f.key,
+		ID:        id,
+		TTL:       uint8(ttl),
+		TimeStamp: time.Now(),
+	})
+
+	var err error
+	switch {
+	case t.Af == "ip6" && t.Protocol == "tcp":
+		_, err = s.conn.WriteTo(t.BuildIPv6TCPSYN(f.sport, s.dport, id), &ControlMessage{TTL: ttl, TOS: t.TOS}, &net.IPAddr{IP: t.NetDstAddr})
+	case t.Af == "ip6":
+		_, err = s.conn.WriteTo(t.BuildIPv6UDPkt(f.sport, s.dport, uint16(id)), &ControlMessage{TTL: ttl, TOS: t.TOS}, &net.IPAddr{IP: t.NetDstAddr})
+	case t.Protocol == "tcp":
+		hdr, payload := t.BuildIPv4TCPSYN(f.sport, s.dport, uint8(ttl), id, t.TOS)
+		err = s.raw.WriteTo(hdr, payload, nil)
+	default:
+		hdr, payload := t.BuildIPv4UDPkt(f.sport, s.dport, uint8(ttl), uint16(id), t.TOS)
+		err = s.raw.WriteTo(hdr, payload, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("conn.WriteTo()失败，%s", err)
+	}
+	return nil
+}
+
+// wait waits until flows first to last-1 got their replies for ttl or
+// Timeout passed, and reports false if the trace was stopped.
+func (s *mdaSender) wait(first, last, ttl int) bool {
+	id := uint32(ttl)
+	if s.t.Protocol == "tcp" {
+		id = mdaSeq(ttl)
+	}
+	deadline := time.Now().Add(s.t.Timeout)
+	for time.Now().Before(deadline) {
+		pending := false
+		for _, f := range s.flows[first:last] {
+			if _, ok := f.db.Cache.Load(id); ok {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return true
+		}
+		if !s.t.sleep(10 * time.Millisecond) {
+			return false
+		}
+	}
+	return !s.t.stopped()
+}
+
+func (s *mdaSender) close() {
+	if s.raw != nil {
+		s.raw.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// mdaSeq is the TCP sequence number of the probe with ttl.
+func mdaSeq(ttl int) uint32 {
+	return uint32(1000 + ttl*4)
+}
+
+// interfaces returns the distinct addresses that answered probes with ttl,
+// sorted.
+func (t *TraceRoute) interfaces(ttl int) []string {
+	server := t.server(uint8(ttl))
+	if server == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var addrs []string
+	server.Lock.Lock()
+	for _, s := range server.Samples {
+		if s.Received && !seen[s.Responder] {
+			seen[s.Responder] = true
+			addrs = append(addrs, s.Responder)
+		}
+	}
+	server.Lock.Unlock()
+	sort.Strings(addrs)
+	return addrs
+}
@@ -0,0 +1,81 @@
+package ztrace
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/icmp"
+)
+
+// MPLSLabel is an MPLS label stack entry quoted by a hop in the RFC 4884
+// extension of its ICMP error, as described in RFC 4950.
+type MPLSLabel struct {
+	Label uint32 `json:"label"`
+	TC    uint8  `json:"tc"` // traffic class, formerly EXP
+	S     bool   `json:"s"`  // bottom of stack
+	TTL   uint8  `json:"ttl"`
+}
+
+// String formats the entry like traceroute -e.
+func (l MPLSLabel) String() string {
+	s := 0
+	if l.S {
+		s = 1
+	}
+	return fmt.Sprintf("L=%d,E=%d,S=%d,T=%d", l.Label, l.TC, s, l.TTL)
+}
+
+// formatMPLS formats a label stack like traceroute -e, top entry first.
+func formatMPLS(labels []MPLSLabel) string {
+	entries := make([]string, len(labels))
+	for i, l := range labels {
+		entries[i] = l.String()
+	}
+	return "<MPLS:" + strings.Join(entries, "/") + ">"
+}
+
+// extensions returns the RFC 4884 extension objects of an ICMP error.
+// icmp.ParseMessage already checks the version and checksum of the extension
+// structure and drops it when they are wrong.
+func extensions(body icmp.MessageBody) []icmp.Extension {
+	switch pkt := body.(type) {
+	case *icmp.TimeExceeded:
+		return pkt.Extensions
+	case *icmp.DstUnreach:
+		return pkt.Extensions
+	case *icmp.ParamProb:
+		return pkt.Extensions
+	}
+	return nil
+}
+
+// mplsLabels returns the MPLS label stack carried in the extensions of an
+// ICMP error.
+func mplsLabels(body icmp.MessageBody) []MPLSLabel {
+	var labels []MPLSLabel
+	for _, ext := range extensions(body) {
+		stack, ok := ext.(*icmp.MPLSLabelStack)
+		if !ok {
+			continue
+		}
+		for _, l := range stack.Labels {
+			labels = append(labels, MPLSLabel{
+				Label: uint32(l.Label),
+				TC:    uint8(l.TC),
+				S:     l.S,
+				TTL:   uint8(l.TTL),
+			})
+		}
+	}
+	return labels
+}
+
+// parseBody returns the body of the raw ICMP message b, or nil when it does
+// not parse.
+func parseBody(proto int, b []byte) icmp.MessageBody {
+	m, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return nil
+	}
+	return m.Body
+}
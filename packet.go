@@ -88,7 +88,7 @@ func (u *UDPHeader) checksum(ip *ipv4.Header, payload []byte) {
 	pseudoHeader = append(pseudoHeader, []byte{
 		0,
 		17,
-		0, byte(u.Length),
+		byte(u.Length >> 8), byte(u.Length),
 	}...)
 
 	var b bytes.Buffer
@@ -116,14 +116,31 @@ func (t *TCPHeader) checksum(ip *ipv4.Header, payload []byte) {
 	t.Checksum = checkSum(b.Bytes())
 }
 
+// udpProbeSize4 and udpProbeSize6 are the packet sizes of UDP probes outside
+// PMTU mode: the headers and 32 bytes of payload.
+const (
+	udpProbeSize4 = ipv4.HeaderLen + 8 + 32
+	udpProbeSize6 = 40 + 8 + 32
+)
+
 func (t *TraceRoute) BuildIPv4UDPkt(srcPort uint16, dstPort uint16, ttl uint8, id uint16, tos int) (*ipv4.Header, []byte) {
+	return t.buildIPv4UDP(srcPort, dstPort, ttl, id, tos, udpProbeSize4, false)
+}
+
+// buildIPv4UDP builds a UDP probe of size bytes in all, with DF set if df.
+// Payload past the first 32 bytes is zero.
+func (t *TraceRoute) buildIPv4UDP(srcPort uint16, dstPort uint16, ttl uint8, id uint16, tos int, size int, df bool) (*ipv4.Header, []byte) {
+	var flags ipv4.HeaderFlags
+	if df {
+		flags = ipv4.DontFragment
+	}
 	iph := &ipv4.Header{
 		Version:  ipv4.Version,
 		TOS:      tos,
 		Len:      ipv4.HeaderLen,
-		TotalLen: 60,
+		TotalLen: size,
 		ID:       int(id),
-		Flags:    0,
+		Flags:    flags,
 		FragOff:  0,
 		TTL:      int(ttl),
 		Protocol: 17,
@@ -144,12 +161,21 @@ func (t *TraceRoute) BuildIPv4UDPkt(srcPort uint16, dstPort uint16, ttl uint8, i
 		Dst: dstPort,
 	}
 
-	payload := make([]byte, 32)
-	for i := 0; i < 32; i++ {
+	payload := make([]byte, size-ipv4.HeaderLen-8)
+	for i := 0; i < 32 && i < len(payload); i++ {
 		payload[i] = uint8(i + 64)
 	}
 	udp.Length = uint16(len(payload) + 8)
+	if t.Paris {
+		payload[0], payload[1] = 0, 0
+	}
 	udp.checksum(iph, payload)
+	if t.Paris {
+		// Paris模式下用UDP校验和携带id，五元组保持不变
+		binary.BigEndian.PutUint16(payload[0:2], parisTweak(udp.Chksum, id))
+		udp.Chksum = 0
+		udp.checksum(iph, payload)
+	}
 
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, &udp)
@@ -157,6 +183,109 @@ func (t *TraceRoute) BuildIPv4UDPkt(srcPort uint16, dstPort uint16, ttl uint8, i
 	return iph, buf.Bytes()
 }
 
+// ipv6PseudoHeader is the IPv6 pseudo-header of RFC 8200 section 8.1 that
+// UDP and TCP checksums cover.
+func ipv6PseudoHeader(src, dst net.IP, proto uint8, length int) []byte {
+	b := make([]byte, 40)
+	copy(b[0:16], src.To16())
+	copy(b[16:32], dst.To16())
+	binary.BigEndian.PutUint32(b[32:36], uint32(length))
+	b[39] = proto
+	return b
+}
+
+// BuildIPv6UDPkt builds a UDP datagram for a raw ip6:udp socket; the kernel
+// adds the IPv6 header but leaves the checksum to us. ICMPv6 errors quote the
+// whole probe, so id is carried in the first two payload bytes, or in the
+// checksum in Paris mode.
+func (t *TraceRoute) BuildIPv6UDPkt(srcPort uint16, dstPort uint16, id uint16) []byte {
+	return t.buildIPv6UDP(srcPort, dstPort, id, udpProbeSize6)
+}
+
+// buildIPv6UDP builds a UDP datagram that makes an IPv6 packet of size bytes.
+// IPv6 routers never fragment, so there is no DF to set.
+func (t *TraceRoute) buildIPv6UDP(srcPort uint16, dstPort uint16, id uint16, size int) []byte {
+	payload := make([]byte, size-40-8)
+	for i := 0; i < 32 && i < len(payload); i++ {
+		payload[i] = uint8(i + 64)
+	}
+	if t.Paris {
+		payload[0], payload[1] = 0, 0
+	} else {
+		binary.BigEndian.PutUint16(payload[0:2], id)
+	}
+
+	b := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], srcPort)
+	binary.BigEndian.PutUint16(b[2:4], dstPort)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	copy(b[8:], payload)
+	pseudo := ipv6PseudoHeader(t.NetSrcAddr, t.NetDstAddr, 17, len(b))
+	sum := checkSum(append(pseudo, b...))
+	if t.Paris {
+		binary.BigEndian.PutUint16(b[8:10], parisTweak(sum, id))
+		sum = checkSum(append(pseudo, b...))
+	}
+	binary.BigEndian.PutUint16(b[6:8], sum)
+	return b
+}
+
+// parisTweak returns the 16-bit payload word that turns a checksum of sum,
+// computed with that word zero, into want. It is how Paris mode carries the
+// probe ID in the UDP checksum.
+func parisTweak(sum, want uint16) uint16 {
+	x := uint32(^want) + uint32(sum)
+	x = x&0xffff + x>>16
+	return uint16(x)
+}
+
+// BuildIPv6TCPSYN builds a TCP SYN segment for a raw ip6:tcp socket with the
+// same options as BuildIPv4TCPSYN.
+func (t *TraceRoute) BuildIPv6TCPSYN(srcPort uint16, dstPort uint16, seq uint32) []byte {
+	tcp := TCPHeader{
+		Src:        srcPort,
+		Dst:        dstPort,
+		SeqNum:     seq,
+		AckNum:     0,
+		DataOffset: 160,
+		Flags:      TCP_SYN,
+		Window:     64240,
+		Urgent:     0,
+	}
+
+	payload := []byte{0x02, 0x04, 0x05, 0xb4, 0x04, 0x02, 0x08, 0x0a, 0x7f, 0x73, 0xf9, 0x3a, 0x00, 0x00, 0x00, 0x00, 0x01, 0x03, 0x03, 0x07}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &tcp)
+	binary.Write(&b, binary.BigEndian, &payload)
+	seg := b.Bytes()
+	sum := checkSum(append(ipv6PseudoHeader(t.NetSrcAddr, t.NetDstAddr, 6, len(seg)), seg...))
+	binary.BigEndian.PutUint16(seg[16:18], sum)
+	return seg
+}
+
+// BuildIPv6TCPRST builds the TCP RST segment that tears down the half-open
+// connection of a SYN-ACK, for a raw ip6:tcp socket.
+func (t *TraceRoute) BuildIPv6TCPRST(srcPort uint16, dstPort uint16, seq uint32) []byte {
+	tcp := TCPHeader{
+		Src:        srcPort,
+		Dst:        dstPort,
+		SeqNum:     seq,
+		AckNum:     0,
+		DataOffset: 80,
+		Flags:      TCP_RST,
+		Window:     0,
+		Urgent:     0,
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, &tcp)
+	seg := b.Bytes()
+	sum := checkSum(append(ipv6PseudoHeader(t.NetSrcAddr, t.NetDstAddr, 6, len(seg)), seg...))
+	binary.BigEndian.PutUint16(seg[16:18], sum)
+	return seg
+}
+
 func (t *TraceRoute) BuildIPv4TCPSYN(srcPort uint16, dstPort uint16, ttl uint8, seq uint32, tos int) (*ipv4.Header, []byte) {
 	iph := &ipv4.Header{
 		Version:  ipv4.Version,
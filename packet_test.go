@@ -0,0 +1,42 @@
+package ztrace
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParisTweak(t *testing.T) {
+	b := []byte{0x12, 0x34, 0xab, 0xcd, 0x00, 0x00, 0x01, 0x02, 0xff}
+	sum := checkSum(b)
+	for _, want := range []uint16{1, 2, 0x1234, 0x7fff, 0x8000, 0xfffe} {
+		binary.BigEndian.PutUint16(b[4:6], parisTweak(sum, want))
+		if got := checkSum(b); got != want {
+			t.Errorf("checksum with the word tweaked for %#x = %#x", want, got)
+		}
+		b[4], b[5] = 0, 0
+	}
+}
+
+func TestParisUDPChecksum(t *testing.T) {
+	tr := &TraceRoute{
+		Paris:      true,
+		NetSrcAddr: net.ParseIP("192.0.2.1"),
+		NetDstAddr: net.ParseIP("198.51.100.1"),
+	}
+	tr6 := &TraceRoute{
+		Paris:      true,
+		NetSrcAddr: net.ParseIP("2001:db8::2"),
+		NetDstAddr: net.ParseIP("2001:db8:1::1"),
+	}
+	for _, id := range []uint16{1, 2, 0x1234, 0x7fff} {
+		_, b := tr.BuildIPv4UDPkt(33434, 33434, 1, id, 0)
+		if got := binary.BigEndian.Uint16(b[6:8]); got != id {
+			t.Errorf("IPv4 probe %#x has checksum %#x", id, got)
+		}
+		b = tr6.BuildIPv6UDPkt(33434, 33434, id)
+		if got := binary.BigEndian.Uint16(b[6:8]); got != id {
+			t.Errorf("IPv6 probe %#x has checksum %#x", id, got)
+		}
+	}
+}
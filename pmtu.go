@@ -0,0 +1,360 @@
+package ztrace
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maxMTU is the largest packet size an IP header can carry.
+const maxMTU = 65535
+
+// mtuPlateaus are the common link MTUs, largest first, that PMTU mode steps
+// down through when a router sends no next-hop MTU or large probes vanish,
+// after RFC 1191.
+var mtuPlateaus = []int{9000, 4352, 2002, 1500, 1492, 1480, 1460, 1450, 1400, 1300, 1280, 1006, 576, 508, 296, 68}
+
+// minMTU is the smallest MTU links of the address family af may have.
+func minMTU(af string) int {
+	if af == "ip6" {
+		return 1280
+	}
+	return 68
+}
+
+// nextPlateau returns the largest plateau below size, at least the minimum
+// MTU of the trace.
+func (t *TraceRoute) nextPlateau(size int) int {
+	for _, p := range mtuPlateaus {
+		if p < size && p >= minMTU(t.Af) {
+			return p
+		}
+	}
+	return minMTU(t.Af)
+}
+
+// ResultMTUDrop is a link where the path MTU goes down to MTU, in front of
+// the hop at TTL. Addr is the router that reported it with Fragmentation
+// Needed or Packet Too Big; a BlackHole drops larger packets without any
+// error, and MTU is then the largest probe size that still got through.
+type ResultMTUDrop struct {
+	TTL       int    `json:"ttl"`
+	Addr      string `json:"addr,omitempty"`
+	MTU       int    `json:"mtu"`
+	BlackHole bool   `json:"black_hole,omitempty"`
+}
+
+// ResultPMTU is the outcome of PMTU mode.
+type ResultPMTU struct {
+	MTU   int             `json:"mtu"` // path MTU found so far
+	Drops []ResultMTUDrop `json:"drops,omitempty"`
+}
+
+// PathMTU returns the path MTU found so far by a PMTU trace, and where it
+// went down.
+func (t *TraceRoute) PathMTU() (int, []ResultMTUDrop) {
+	t.pmtuMu.Lock()
+	defer t.pmtuMu.Unlock()
+	return t.pathMTU, append([]ResultMTUDrop(nil), t.mtuDrops...)
+}
+
+// lowerMTU records that packets larger than mtu do not get past the link in
+// front of drop.TTL, unless a smaller MTU is known already.
+func (t *TraceRoute) lowerMTU(drop ResultMTUDrop) {
+	t.pmtuMu.Lock()
+	defer t.pmtuMu.Unlock()
+	if drop.MTU >= t.pathMTU {
+		return
+	}
+	t.pathMTU = drop.MTU
+	t.mtuDrops = append(t.mtuDrops, drop)
+}
+
+// tooBig reports whether v is a Fragmentation Needed or a Packet Too Big.
+func (t *TraceRoute) tooBig(v *RecvMetric) bool {
+	if t.Af == "ip6" {
+		return v.ICMPType == int(ipv6.ICMPTypePacketTooBig)
+	}
+	return v.ICMPType == int(ipv4.ICMPTypeDestinationUnreachable) && v.ICMPCode == 4
+}
+
+// recordTooBig lowers the path MTU to the next-hop MTU of v. The probe is
+// sent again smaller, so it does not count as a probe of its hop.
+func (t *TraceRoute) recordTooBig(v *RecvMetric, probe *SendMetric) {
+	if server := t.server(probe.TTL); server != nil {
+		server.Lock.Lock()
+		server.SendCnt--
+		server.Lock.Unlock()
+	}
+	mtu := v.MTU
+	// 老的路由器不带下一跳MTU，按RFC 1191取下一档
+	if mtu < minMTU(t.Af) || mtu >= probe.Size {
+		mtu = t.nextPlateau(probe.Size)
+	}
+	t.lowerMTU(ResultMTUDrop{TTL: int(probe.TTL), Addr: v.RespAddr, MTU: mtu})
+}
+
+// TracePMTU traces the path like TraceUDP, one TTL at a time, with probes
+// that routers may not fragment: DF is set on IPv4 and IPv6 routers never
+// fragment. Probes start at MTU bytes and shrink to the next-hop MTU of every
+// Fragmentation Needed or Packet Too Big. When the probes of a TTL all
+// vanish but a small one is answered, the link in front of the hop is a
+// black hole and the largest plateau that gets through is taken instead.
+func (t *TraceRoute) TracePMTU() (err error) {
+	var handlers []func() error
+
+	// 接收的socket要在发包之前打开
+	if t.Af == "ip6" {
+		conn, err := t.listenIPv6ICMP()
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, func() error {
+			return t.recvIPv6ICMP(conn)
+		})
+	} else {
+		conn, err := t.listenIPv4ICMP()
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, func() error {
+			return t.recvIPv4ICMP(conn)
+		})
+	}
+
+	t.markStart()
+	handlers = append(handlers, func() error {
+		defer atomic.StoreInt32(&t.senderDone, 1)
+		return t.SendPMTU()
+	})
+
+	return GoroutineNotPanic(handlers...)
+}
+
+// pmtuSender sends the probes of a PMTU trace, all of one flow.
+type pmtuSender struct {
+	t            *TraceRoute
+	sport, dport uint16
+	key          string
+	db           *StatsDB
+	id           uint16
+	raw          RawConn
+	conn         PacketConn
+}
+
+func (t *TraceRoute) SendPMTU() error {
+	s := &pmtuSender{
+		t:     t,
+		sport: uint16(1000 + t.PortOffset + rand.Int31n(500)),
+		dport: uint16(33434 + rand.Int31n(64)),
+		id:    1,
+	}
+	var err error
+	if t.Af == "ip6" {
+		s.key = GetHash(t.NetSrcAddr.To16(), t.NetDstAddr.To16(), s.sport, s.dport, 17)
+		s.conn, err = t.transport().ListenPacket("ip6:udp", t.SrcAddr)
+	} else {
+		s.key = GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), s.sport, s.dport, 17)
+		s.raw, err = t.transport().ListenRaw("ip4:udp", t.NetSrcAddr.String())
+	}
+	if err != nil {
+		logrus.Error("can not create raw socket:", err)
+		return err
+	}
+	defer s.close()
+	s.db = t.newFlow(s.key)
+
+	dst := t.NetDstAddr.String()
+	silent := 0
+	for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+		if err := s.probeTTL(ttl); err != nil {
+			if t.stopped() {
+				return nil
+			}
+			return err
+		}
+		server := t.server(uint8(ttl))
+		server.Lock.Lock()
+		reached, success := server.hasResponder(dst), server.Success
+		server.Lock.Unlock()
+		if stop := t.flowLimit(s.key, 0); reached || (stop > 0 && stop <= ttl) {
+			return nil
+		}
+		if success {
+			silent = 0
+		} else if silent++; t.GapLimit > 0 && silent >= t.GapLimit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// errStopped ends a PMTU trace that was stopped while waiting.
+var errStopped = errors.New("trace stopped")
+
+// probeTTL sends Count probes of the path MTU with ttl, again smaller as long
+// as they are too big, then looks for a black hole if none was answered.
+func (s *pmtuSender) probeTTL(ttl int) error {
+	t := s.t
+	for {
+		size, _ := t.PathMTU()
+		before := s.received(ttl)
+		var ids []uint32
+		for i := 0; i < t.Count; i++ {
+			id, err := s.send(ttl, size)
+			if err != nil {
+				return err
+			}
+			if id != 0 {
+				ids = append(ids, id)
+			}
+		}
+		if !s.wait(ids) {
+			return errStopped
+		}
+		if mtu, _ := t.PathMTU(); mtu < size {
+			continue
+		}
+		if s.received(ttl) > before || size <= s.smallSize() {
+			return nil
+		}
+		break
+	}
+
+	// 大包都没有回复，用小包确认这一跳是否会回复
+	answered, err := s.probe(ttl, s.smallSize())
+	if err != nil || !answered {
+		return err
+	}
+	size, _ := t.PathMTU()
+	for _, p := range mtuPlateaus {
+		if p >= size || p < minMTU(t.Af) {
+			continue
+		}
+		answered, err := s.probe(ttl, p)
+		if err != nil {
+			return err
+		}
+		if mtu, _ := t.PathMTU(); mtu < p {
+			// 更小的包收到了Packet Too Big，不是黑洞
+			return nil
+		}
+		if answered {
+			t.lowerMTU(ResultMTUDrop{TTL: ttl, MTU: p, BlackHole: true})
+			return nil
+		}
+	}
+	t.lowerMTU(ResultMTUDrop{TTL: ttl, MTU: minMTU(t.Af), BlackHole: true})
+	return nil
+}
+
+// probe sends a single probe of size bytes with ttl and reports whether the
+// hop answered it.
+func (s *pmtuSender) probe(ttl, size int) (bool, error) {
+	before := s.received(ttl)
+	id, err := s.send(ttl, size)
+	if err != nil {
+		return false, err
+	}
+	if id != 0 && !s.wait([]uint32{id}) {
+		return false, errStopped
+	}
+	return s.received(ttl) > before, nil
+}
+
+// smallSize is the size of the probes outside PMTU mode.
+func (s *pmtuSender) smallSize() int {
+	if s.t.Af == "ip6" {
+		return udpProbeSize6
+	}
+	return udpProbeSize4
+}
+
+// send sends a probe of size bytes with ttl and returns its ID. A probe
+// larger than the MTU of the local link is not sent: the path MTU goes down
+// to the next plateau and the ID is 0.
+func (s *pmtuSender) send(ttl, size int) (uint32, error) {
+	t := s.t
+	if !t.pace() {
+		return 0, errStopped
+	}
+	id := s.id
+	// ID 0表示没有发出去，回绕时跳过
+	if s.id = (s.id + 1) % (1 << 15); s.id == 0 {
+		s.id = 1
+	}
+	var err error
+	if t.Af == "ip6" {
+		pkt := t.buildIPv6UDP(s.sport, s.dport, id, size)
+		// 不设DONTFRAG的话，内核会把超过本地MTU的包分片发出去
+		_, err = s.conn.WriteTo(pkt, &ControlMessage{TTL: ttl, TOS: t.TOS, DontFragment: true}, &net.IPAddr{IP: t.NetDstAddr})
+	} else {
+		hdr, payload := t.buildIPv4UDP(s.sport, s.dport, uint8(ttl), id, t.TOS, size, true)
+		err = s.raw.WriteTo(hdr, payload, nil)
+	}
+	// 包太大时本地就发不出去，所以发完才记
+	if errors.Is(err, syscall.EMSGSIZE) && size > minMTU(t.Af) {
+		t.lowerMTU(ResultMTUDrop{Addr: t.NetSrcAddr.String(), MTU: t.nextPlateau(size)})
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("conn.WriteTo()失败，%s", err)
+	}
+
+	atomic.AddUint64(s.db.SendCnt, 1)
+	t.RecordSend(&SendMetric{
+		FlowKey:   s.key,
+		ID:        uint32(id),
+		TTL:       uint8(ttl),
+		TimeStamp: time.Now(),
+		Size:      size,
+	})
+	return uint32(id), nil
+}
+
+// wait waits until the probes ids got a reply or Timeout passed, and reports
+// false if the trace was stopped.
+func (s *pmtuSender) wait(ids []uint32) bool {
+	deadline := time.Now().Add(s.t.Timeout)
+	for time.Now().Before(deadline) {
+		pending := false
+		for _, id := range ids {
+			if _, ok := s.db.Cache.Load(id); ok {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return true
+		}
+		if !s.t.sleep(10 * time.Millisecond) {
+			return false
+		}
+	}
+	return !s.t.stopped()
+}
+
+// received returns the replies recorded for ttl so far.
+func (s *pmtuSender) received(ttl int) uint64 {
+	server := s.t.server(uint8(ttl))
+	server.Lock.Lock()
+	defer server.Lock.Unlock()
+	return server.RecvCnt
+}
+
+func (s *pmtuSender) close() {
+	if s.raw != nil {
+		s.raw.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
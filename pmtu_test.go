@@ -0,0 +1,26 @@
+package ztrace
+
+import "testing"
+
+func TestNextPlateau(t *testing.T) {
+	tests := []struct {
+		af         string
+		size, want int
+	}{
+		{"ip4", 65535, 9000},
+		{"ip4", 9000, 4352},
+		{"ip4", 1500, 1492},
+		{"ip4", 1499, 1492},
+		{"ip4", 296, 68},
+		{"ip4", 68, 68},
+		{"ip6", 1500, 1492},
+		{"ip6", 1300, 1280},
+		{"ip6", 1280, 1280},
+	}
+	for _, tt := range tests {
+		tr := &TraceRoute{Af: tt.af}
+		if got := tr.nextPlateau(tt.size); got != tt.want {
+			t.Errorf("%v nextPlateau(%v) = %v, want %v", tt.af, tt.size, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package ztrace
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket paces probes to a rate of tokens per second with a burst of
+// one token, so probes leave evenly spaced instead of back to back.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token at rate per second and returns how long to wait
+// before using it. Tokens taken ahead of time are owed, so concurrent
+// senders queue up behind each other. A rate of 0 is unlimited.
+func (b *tokenBucket) reserve(rate float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = 1
+	} else if now.After(b.last) {
+		b.tokens = math.Min(1, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+var (
+	globalRate   uint64 // math.Float64bits of the process-wide probe rate
+	globalBucket tokenBucket
+)
+
+// SetGlobalPacketRate caps the probes per second sent by all the traces of
+// the process together, on top of the PacketRate of each trace. 0, the
+// default, is unlimited. The default GlobalTimeout of the traces created
+// afterwards is long enough for one trace at this rate; traces that run at
+// the same time share it and need their GlobalTimeout set explicitly.
+func SetGlobalPacketRate(rate float64) {
+	if rate < 0 {
+		rate = 0
+	}
+	atomic.StoreUint64(&globalRate, math.Float64bits(rate))
+}
+
+// GlobalPacketRate returns the rate set by SetGlobalPacketRate.
+func GlobalPacketRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&globalRate))
+}
+
+// pace waits until both PacketRate and the global packet rate allow one more
+// probe, and reports false if the trace was stopped.
+func (t *TraceRoute) pace() bool {
+	if t.stopped() {
+		return false
+	}
+	now := time.Now()
+	d := t.bucket.reserve(float64(t.PacketRate), now)
+	if g := globalBucket.reserve(GlobalPacketRate(), now); g > d {
+		d = g
+	}
+	return d <= 0 || t.sleep(d)
+}
@@ -0,0 +1,31 @@
+package ztrace
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Now()
+	if d := b.reserve(0, now); d != 0 {
+		t.Errorf("unlimited reserve waits %v", d)
+	}
+	// 第一个令牌立即可用，之后按速率排队
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if d := b.reserve(10, now); d != want {
+			t.Errorf("reserve #%v waits %v, want %v", i, d, want)
+		}
+	}
+	if d := b.reserve(10, now.Add(150*time.Millisecond)); d != 150*time.Millisecond {
+		t.Errorf("reserve after 150ms waits %v, want 150ms", d)
+	}
+	// 空闲很久也只攒一个令牌
+	later := now.Add(10 * time.Second)
+	if d := b.reserve(10, later); d != 0 {
+		t.Errorf("reserve after idling waits %v, want 0", d)
+	}
+	if d := b.reserve(10, later); d != 100*time.Millisecond {
+		t.Errorf("second reserve after idling waits %v, want 100ms", d)
+	}
+}
@@ -0,0 +1,40 @@
+package ztrace
+
+// asymmetricHops is how many hops longer than its forward TTL the return
+// path of a hop has to be to flag the hop as asymmetric.
+const asymmetricHops = 3
+
+// replyTTL returns the TTL or hop limit a reply arrived with, 0 when the
+// platform does not report it.
+func replyTTL(cm *ControlMessage) int {
+	if cm == nil {
+		return 0
+	}
+	return cm.TTL
+}
+
+// initialTTL infers the TTL a reply was sent with from the TTL it arrived
+// with: the smallest of the common initial TTLs 64, 128 and 255 that is not
+// below it.
+func initialTTL(replyTTL int) int {
+	switch {
+	case replyTTL <= 64:
+		return 64
+	case replyTTL <= 128:
+		return 128
+	}
+	return 255
+}
+
+// returnPath returns the initial TTL of a reply that arrived with replyTTL
+// from the hop at ttl, the hops it crossed on the way back counting the
+// responder like ttl does, and whether that is much more than ttl. They
+// are zero when replyTTL is unknown.
+func returnPath(ttl, replyTTL int) (initial, hops int, asymmetric bool) {
+	if replyTTL <= 0 {
+		return 0, 0, false
+	}
+	initial = initialTTL(replyTTL)
+	hops = initial - replyTTL + 1
+	return initial, hops, hops-ttl >= asymmetricHops
+}
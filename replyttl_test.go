@@ -0,0 +1,33 @@
+package ztrace
+
+import "testing"
+
+func TestInitialTTL(t *testing.T) {
+	for reply, want := range map[int]int{1: 64, 50: 64, 64: 64, 65: 128, 128: 128, 129: 255, 255: 255} {
+		if got := initialTTL(reply); got != want {
+			t.Errorf("initialTTL(%v) = %v, want %v", reply, got, want)
+		}
+	}
+}
+
+func TestReturnPath(t *testing.T) {
+	tests := []struct {
+		ttl, reply    int
+		initial, hops int
+		asymmetric    bool
+	}{
+		{3, 62, 64, 3, false},
+		{3, 61, 64, 4, false},
+		{2, 60, 64, 5, true},
+		{5, 250, 255, 6, false},
+		{1, 120, 128, 9, true},
+		{4, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		initial, hops, asymmetric := returnPath(tt.ttl, tt.reply)
+		if initial != tt.initial || hops != tt.hops || asymmetric != tt.asymmetric {
+			t.Errorf("returnPath(%v, %v) = %v, %v, %v, want %v, %v, %v", tt.ttl, tt.reply,
+				initial, hops, asymmetric, tt.initial, tt.hops, tt.asymmetric)
+		}
+	}
+}
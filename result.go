@@ -0,0 +1,299 @@
+package ztrace
+
+import (
+	"sort"
+	"time"
+)
+
+// ResultSchemaVersion is the version of the TraceResult JSON encoding. It is
+// bumped when a field is renamed, removed or changes meaning; adding a field
+// keeps the version.
+const ResultSchemaVersion = 1
+
+// TraceResult is the outcome of a trace in a form that is stable to encode
+// as JSON. It is filled in the same way for IPv4 and IPv6 traces.
+type TraceResult struct {
+	SchemaVersion int               `json:"schema_version"`
+	Source        string            `json:"source"`
+	Destination   string            `json:"destination"`
+	DestinationIP string            `json:"destination_ip"`
+	AddressFamily string            `json:"address_family"`
+	Protocol      string            `json:"protocol"`
+	StartTime     time.Time         `json:"start_time"`
+	EndTime       time.Time         `json:"end_time"`
+	Parameters    ResultParameters  `json:"parameters"`
+	Reached       bool              `json:"reached"`
+	TCPPortState  TCPPortState      `json:"tcp_port_state,omitempty"`
+	TCPPorts      []ResultTCPPort   `json:"tcp_ports,omitempty"`
+	PMTU          *ResultPMTU       `json:"pmtu,omitempty"`
+	TOSChanges    []ResultTOSChange `json:"tos_changes,omitempty"`
+	Hops          []ResultHop       `json:"hops"`
+	Links         []ResultLink      `json:"links,omitempty"`
+}
+
+// ResultParameters records the settings the trace ran with.
+type ResultParameters struct {
+	Count         int     `json:"count"`
+	FirstTTL      int     `json:"first_ttl,omitempty"`
+	MaxTTL        int     `json:"max_ttl"`
+	IntervalMs    float64 `json:"interval_ms"`
+	TimeoutMs     float64 `json:"timeout_ms"`
+	PingType      string  `json:"ping_type,omitempty"`
+	TCPPort       uint16  `json:"tcp_port,omitempty"`
+	Paris         bool    `json:"paris,omitempty"`
+	MDAConfidence float64 `json:"mda_confidence,omitempty"`
+	GapLimit      int     `json:"gap_limit,omitempty"`
+	TOS           int     `json:"tos,omitempty"`
+	PMTU          bool    `json:"pmtu,omitempty"`
+	MTU           int     `json:"mtu,omitempty"`
+	Continuous    bool    `json:"continuous,omitempty"`
+	WindowCycles  int     `json:"window_cycles,omitempty"`
+	WindowMs      float64 `json:"window_ms,omitempty"`
+}
+
+// ResultHop is the summary of one TTL. Addr is empty when no probe sent with
+// this TTL was answered; Interfaces lists every address that answered.
+type ResultHop struct {
+	TTL           int               `json:"ttl"`
+	Addr          string            `json:"addr"`
+	Interfaces    []string          `json:"interfaces,omitempty"`
+	Responders    []ResultResponder `json:"responders,omitempty"`
+	Sent          int               `json:"sent"`
+	Received      int               `json:"received"`
+	LossPct       float64           `json:"loss_pct"` // over the probes answered or timed out
+	LastMs        float64           `json:"last_ms"`
+	AvgMs         float64           `json:"avg_ms"`
+	BestMs        float64           `json:"best_ms"`
+	WorstMs       float64           `json:"worst_ms"`
+	MPLS          []MPLSLabel       `json:"mpls,omitempty"`           // label stack last quoted by Addr
+	InterfaceInfo []InterfaceInfo   `json:"interface_info,omitempty"` // RFC 5837 objects last quoted by Addr
+	QuotedTOS     *int              `json:"quoted_tos,omitempty"`     // TOS of the probe last quoted by Addr
+	Unreachable   *Unreachable      `json:"unreachable,omitempty"`    // ICMP error Addr ended the path with
+	ReplyPath                       // return path of Addr
+	Samples       []ProbeSample     `json:"samples"`
+}
+
+// ResultResponder is the summary of one address answering at a TTL. Probes
+// of a flow that went unanswered count against the last responder of the
+// flow.
+type ResultResponder struct {
+	Addr          string          `json:"addr"`
+	Sent          int             `json:"sent"`
+	Received      int             `json:"received"`
+	LossPct       float64         `json:"loss_pct"`
+	LastMs        float64         `json:"last_ms"`
+	AvgMs         float64         `json:"avg_ms"`
+	BestMs        float64         `json:"best_ms"`
+	WorstMs       float64         `json:"worst_ms"`
+	P50Ms         float64         `json:"p50_ms"`
+	P95Ms         float64         `json:"p95_ms"`
+	MPLS          []MPLSLabel     `json:"mpls,omitempty"`           // label stack last quoted
+	InterfaceInfo []InterfaceInfo `json:"interface_info,omitempty"` // RFC 5837 objects last quoted
+	QuotedTOS     *int            `json:"quoted_tos,omitempty"`     // TOS of the probe last quoted
+	Unreachable   *Unreachable    `json:"unreachable,omitempty"`    // ICMP error that ended the path
+	ReplyPath
+}
+
+// ReplyPath is what the TTL of the last reply of a responder tells about the
+// path back from it: the initial TTL it was sent with, 64, 128 or 255, and
+// the hops it crossed counting the responder, comparable to the forward TTL.
+// Asymmetric flags a return path at least 3 hops longer than the forward
+// TTL, a sign of asymmetric routing. All are zero when the platform does
+// not report the TTL of replies.
+type ReplyPath struct {
+	ReplyTTL   int  `json:"reply_ttl,omitempty"`
+	InitialTTL int  `json:"initial_ttl,omitempty"`
+	ReturnHops int  `json:"return_hops,omitempty"`
+	Asymmetric bool `json:"asymmetric,omitempty"`
+}
+
+// replyPath returns the ReplyPath of r answering at ttl.
+func replyPath(ttl int, r *ResponderRecord) ReplyPath {
+	initial, hops, asymmetric := returnPath(ttl, r.ReplyTTL)
+	return ReplyPath{ReplyTTL: r.ReplyTTL, InitialTTL: initial, ReturnHops: hops, Asymmetric: asymmetric}
+}
+
+// ResultLink is a link between an interface answering at TTL-1 and one
+// answering at TTL, seen when a flow crossed both.
+type ResultLink struct {
+	TTL  int    `json:"ttl"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ProbeSample is a single probe and its reply, if any.
+type ProbeSample struct {
+	ID            uint32          `json:"id"`
+	Flow          string          `json:"flow"`
+	Cycle         int             `json:"cycle"`
+	SentAt        time.Time       `json:"sent_at"`
+	Received      bool            `json:"received"`
+	Responder     string          `json:"responder,omitempty"`
+	RTTMs         float64         `json:"rtt_ms"`
+	ICMPType      int             `json:"icmp_type"`
+	ICMPCode      int             `json:"icmp_code"`
+	MPLS          []MPLSLabel     `json:"mpls,omitempty"`
+	InterfaceInfo []InterfaceInfo `json:"interface_info,omitempty"`
+	ReplyTTL      int             `json:"reply_ttl,omitempty"` // 0 when the platform does not report it
+	QuotedTOS     *int            `json:"quoted_tos,omitempty"`
+}
+
+// Result collects what the trace has recorded so far into a TraceResult.
+// Hops stop at the destination, at the first hop that answered with an
+// Unreachable, or at the last TTL that got any reply.
+func (t *TraceRoute) Result() *TraceResult {
+	r := &TraceResult{
+		SchemaVersion: ResultSchemaVersion,
+		Source:        t.SrcAddr,
+		Destination:   t.Dest,
+		AddressFamily: t.Af,
+		Protocol:      t.Protocol,
+		StartTime:     t.StartTime,
+		EndTime:       t.endTime(),
+		Parameters: ResultParameters{
+			Count:      t.Count,
+			MaxTTL:     t.MaxTTL,
+			IntervalMs: durationMs(t.Interval),
+			TimeoutMs:  durationMs(t.Timeout),
+		},
+		Hops: make([]ResultHop, 0),
+	}
+	if t.NetSrcAddr != nil {
+		r.Source = t.NetSrcAddr.String()
+	}
+	if t.NetDstAddr != nil {
+		r.DestinationIP = t.NetDstAddr.String()
+	}
+	switch t.Protocol {
+	case "icmp":
+		r.Parameters.PingType = t.PingType
+	case "tcp":
+		r.Parameters.TCPPort = t.TCPDPort
+		r.TCPPortState = t.TCPPortState(t.TCPDPort)
+		if t.TCPMultiPort {
+			r.TCPPorts = t.TCPPortResults()
+		}
+	}
+	r.Parameters.Paris = t.Paris
+	r.Parameters.GapLimit = t.GapLimit
+	r.Parameters.TOS = t.TOS
+	if t.PMTU {
+		r.Parameters.PMTU, r.Parameters.MTU = true, t.MTU
+		r.PMTU = &ResultPMTU{}
+		r.PMTU.MTU, r.PMTU.Drops = t.PathMTU()
+	}
+	if t.firstTTL() > 1 {
+		r.Parameters.FirstTTL = t.FirstTTL
+	}
+	r.Parameters.Continuous = t.Continuous
+	r.Parameters.WindowCycles = t.WindowCycles
+	r.Parameters.WindowMs = durationMs(t.WindowTime)
+	if t.MDA {
+		r.Parameters.MDAConfidence = t.MDAConfidence
+	}
+
+	last := 0
+	for ttl := t.firstTTL(); ttl < len(t.Metric) && ttl <= t.MaxTTL; ttl++ {
+		t.Metric[ttl].Lock.Lock()
+		server := t.view(t.Metric[ttl])
+		hop := ResultHop{
+			TTL:      ttl,
+			Sent:     int(server.SendCnt),
+			Received: int(server.RecvCnt),
+			LossPct:  100,
+			Samples:  append([]ProbeSample{}, server.Samples...),
+		}
+		if server.Success {
+			hop.Addr = server.Addr
+			hop.LastMs = durationMs(server.LastTime)
+			hop.AvgMs = durationMs(server.AvgTime)
+			hop.BestMs = durationMs(server.BestTime)
+			hop.WorstMs = durationMs(server.WrstTime)
+			hop.MPLS = server.primary().MPLS
+			hop.InterfaceInfo = server.primary().InterfaceInfo
+			hop.QuotedTOS = server.primary().QuotedTOS
+			hop.Unreachable = server.primary().Unreachable
+			hop.ReplyPath = replyPath(ttl, server.primary())
+			// 和报告一样不算还在路上的探测
+			hop.LossPct = FloatTrunc(server.Loss, 1)
+			last = len(r.Hops) + 1
+		}
+		for _, resp := range server.Responders {
+			hop.Responders = append(hop.Responders, ResultResponder{
+				Addr:          resp.Addr,
+				Sent:          int(resp.SendCnt),
+				Received:      int(resp.RecvCnt),
+				LossPct:       FloatTrunc(resp.Loss, 1),
+				LastMs:        durationMs(resp.LastTime),
+				AvgMs:         durationMs(resp.AvgTime),
+				BestMs:        durationMs(resp.BestTime),
+				WorstMs:       durationMs(resp.WrstTime),
+				P50Ms:         resp.Quantile.Query(0.5),
+				P95Ms:         resp.Quantile.Query(0.95),
+				MPLS:          resp.MPLS,
+				InterfaceInfo: resp.InterfaceInfo,
+				QuotedTOS:     resp.QuotedTOS,
+				Unreachable:   resp.Unreachable,
+				ReplyPath:     replyPath(ttl, resp),
+			})
+		}
+		end := t.endsPath(ttl, server)
+		server.Lock.Unlock()
+		hop.Interfaces = t.interfaces(ttl)
+
+		r.Hops = append(r.Hops, hop)
+		if hop.Addr != "" && hop.Addr == r.DestinationIP {
+			r.Reached = true
+			break
+		}
+		if end {
+			break
+		}
+	}
+	r.Hops = r.Hops[:last]
+	r.TOSChanges = tosChanges(t.TOS, r.Hops)
+	// ICMP rounds share one flow key, so only UDP and TCP flows give links.
+	if t.Protocol != "icmp" {
+		r.Links = links(r.Hops)
+	}
+	return r
+}
+
+// links pairs the responders of each flow at successive TTLs.
+func links(hops []ResultHop) []ResultLink {
+	seen := make(map[ResultLink]bool)
+	result := make([]ResultLink, 0)
+	prev := make(map[string]string)
+	for _, hop := range hops {
+		cur := make(map[string]string)
+		for _, s := range hop.Samples {
+			if s.Received {
+				cur[s.Flow] = s.Responder
+			}
+		}
+		for flow, to := range cur {
+			from, ok := prev[flow]
+			l := ResultLink{TTL: hop.TTL, From: from, To: to}
+			if ok && !seen[l] {
+				seen[l] = true
+				result = append(result, l)
+			}
+		}
+		prev = cur
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.TTL != b.TTL {
+			return a.TTL < b.TTL
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return result
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
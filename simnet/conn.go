@@ -0,0 +1,225 @@
+package simnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	ztrace "github.com/eaglesunshine/trace"
+	"golang.org/x/net/ipv4"
+)
+
+var errTimeout = &timeoutError{}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// ListenPacket implements ztrace.Transport. The conn writes ICMP and ICMPv6
+// echo requests, or IPv6 transport segments, into the network and reads the
+// replies addressed to it.
+func (n *Network) ListenPacket(network, address string) (ztrace.PacketConn, error) {
+	var proto int
+	v6 := false
+	switch network {
+	case "ip4:icmp", "udp4":
+		proto = protocolICMP
+	case "ip4:tcp":
+		proto = protocolTCP
+	case "ip6:ipv6-icmp", "udp6":
+		proto, v6 = protocolIPv6ICMP, true
+	case "ip6:udp":
+		proto, v6 = protocolUDP, true
+	case "ip6:tcp":
+		proto, v6 = protocolTCP, true
+	default:
+		return nil, fmt.Errorf("simnet: unsupported network %q", network)
+	}
+	c := &packetConn{
+		net:     n,
+		network: network,
+		proto:   proto,
+		v6:      v6,
+		laddr:   net.ParseIP(address),
+		queue:   make(chan *reply, 1024),
+		closed:  make(chan struct{}),
+	}
+	n.mu.Lock()
+	n.conns[c] = struct{}{}
+	n.mu.Unlock()
+	return c, nil
+}
+
+// ListenRaw implements ztrace.Transport. The conn writes probes with a
+// caller built IPv4 header into the network.
+func (n *Network) ListenRaw(network, address string) (ztrace.RawConn, error) {
+	switch network {
+	case "ip4:icmp", "ip4:udp", "ip4:tcp":
+	default:
+		return nil, fmt.Errorf("simnet: unsupported network %q", network)
+	}
+	return &rawConn{net: n, closed: make(chan struct{})}, nil
+}
+
+type packetConn struct {
+	net     *Network
+	network string
+	proto   int
+	v6      bool
+	laddr   net.IP
+	queue   chan *reply
+	closed  chan struct{}
+	once    sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+// deliver queues r if it is addressed to c; the network lock is held.
+func (c *packetConn) deliver(r *reply) {
+	if r.proto != c.proto || c.v6 != (r.dst.To4() == nil) {
+		return
+	}
+	if c.laddr != nil && !c.laddr.IsUnspecified() && !c.laddr.Equal(r.dst) {
+		return
+	}
+	select {
+	case c.queue <- r:
+	default:
+	}
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, *ztrace.ControlMessage, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, nil, c.opError("read", errTimeout)
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-c.queue:
+		n := copy(b, r.data)
+		var src net.Addr = &net.IPAddr{IP: r.src}
+		if c.network == "udp4" || c.network == "udp6" {
+			src = &net.UDPAddr{IP: r.src}
+		}
+		return n, &ztrace.ControlMessage{TTL: r.ttl}, src, nil
+	case <-timeout:
+		return 0, nil, nil, c.opError("read", errTimeout)
+	case <-c.closed:
+		return 0, nil, nil, c.opError("read", net.ErrClosed)
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, cm *ztrace.ControlMessage, dst net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	if !c.v6 && c.proto != protocolICMP {
+		return 0, c.opError("write", errors.New("simnet: only ICMP and IPv6 conns send"))
+	}
+	ttl, tos := 64, 0
+	if cm != nil && cm.TTL > 0 {
+		ttl = cm.TTL
+	}
+	if cm != nil {
+		tos = cm.TOS
+	}
+	var ip net.IP
+	switch a := dst.(type) {
+	case *net.IPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return 0, c.opError("write", fmt.Errorf("simnet: unsupported address %v", dst))
+	}
+	p := &probe{
+		src:     c.laddr,
+		dst:     ip,
+		ttl:     ttl,
+		proto:   c.proto,
+		tos:     tos,
+		payload: append([]byte(nil), b...),
+	}
+	if mtu := c.net.LocalMTU; c.v6 && mtu > 0 && p.size() > mtu {
+		if cm != nil && cm.DontFragment {
+			return 0, c.opError("write", os.NewSyscallError("sendto", syscall.EMSGSIZE))
+		}
+		p = firstFragment(p, mtu)
+	}
+	c.net.send(p)
+	return len(b), nil
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *packetConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.net.mu.Lock()
+		delete(c.net.conns, c)
+		c.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *packetConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.network, Err: err}
+}
+
+type rawConn struct {
+	net    *Network
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *rawConn) WriteTo(h *ipv4.Header, p []byte, cm *ipv4.ControlMessage) error {
+	select {
+	case <-c.closed:
+		return &net.OpError{Op: "write", Net: "ip4", Err: net.ErrClosed}
+	default:
+	}
+	pkt := &probe{
+		src:     h.Src,
+		dst:     h.Dst,
+		ttl:     h.TTL,
+		proto:   h.Protocol,
+		tos:     h.TOS,
+		id:      h.ID,
+		flags:   h.Flags,
+		payload: append([]byte(nil), p...),
+	}
+	if mtu := c.net.LocalMTU; mtu > 0 && pkt.size() > mtu && h.Flags&ipv4.DontFragment != 0 {
+		return &net.OpError{Op: "write", Net: "ip4", Err: os.NewSyscallError("sendto", syscall.EMSGSIZE)}
+	}
+	c.net.send(pkt)
+	return nil
+}
+
+func (c *rawConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
@@ -0,0 +1,285 @@
+package simnet
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+
+	ztrace "github.com/eaglesunshine/trace"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP         = 1
+	protocolTCP          = 6
+	protocolUDP          = 17
+	protocolIPv6ICMP     = 58
+	protocolIPv6Fragment = 44
+
+	// RFC 5837 C-Type flags of the attributes present
+	ifAttrMTU     = 0x01
+	ifAttrName    = 0x02
+	ifAttrIPAddr  = 0x04
+	ifAttrIfIndex = 0x08
+
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// icmpErrorKind is an ICMP error independent of the address family.
+type icmpErrorKind int
+
+const (
+	errTimeExceeded icmpErrorKind = iota
+	errPortUnreachable
+)
+
+func icmpProtocol(p *probe) int {
+	if p.v6() {
+		return protocolIPv6ICMP
+	}
+	return protocolICMP
+}
+
+// extensions returns the RFC 4884 extension objects the router appends to
+// its Time Exceeded messages.
+func (r *Router) extensions() []icmp.Extension {
+	var exts []icmp.Extension
+	if len(r.MPLS) > 0 {
+		stack := &icmp.MPLSLabelStack{Class: 1, Type: 1}
+		for _, l := range r.MPLS {
+			stack.Labels = append(stack.Labels, icmp.MPLSLabel{Label: int(l.Label), TC: int(l.TC), S: l.S, TTL: int(l.TTL)})
+		}
+		exts = append(exts, stack)
+	}
+	for _, info := range r.InterfaceInfo {
+		exts = append(exts, interfaceInfo(info))
+	}
+	return exts
+}
+
+// interfaceInfo encodes info as an RFC 5837 object. The C-Type holds the
+// role in its two high bits and one flag per attribute present.
+func interfaceInfo(info ztrace.InterfaceInfo) *icmp.InterfaceInfo {
+	ifi := &icmp.InterfaceInfo{Class: 2}
+	switch info.Role {
+	case ztrace.InterfaceSubIP:
+		ifi.Type = 1 << 6
+	case ztrace.InterfaceOutgoing:
+		ifi.Type = 2 << 6
+	case ztrace.InterfaceNextHop:
+		ifi.Type = 3 << 6
+	}
+	// 没有ifIndex时icmp包不编码名字和MTU
+	if info.IfIndex > 0 {
+		ifi.Interface = &net.Interface{Index: info.IfIndex, Name: info.Name, MTU: info.MTU}
+		ifi.Type |= ifAttrIfIndex
+		if info.Name != "" {
+			ifi.Type |= ifAttrName
+		}
+		if info.MTU > 0 {
+			ifi.Type |= ifAttrMTU
+		}
+	}
+	if info.Addr != "" {
+		ifi.Addr = &net.IPAddr{IP: net.ParseIP(info.Addr)}
+		ifi.Type |= ifAttrIPAddr
+	}
+	return ifi
+}
+
+// icmpError builds the ICMP or ICMPv6 error src sends about p, quoting p as
+// it arrived, followed by exts.
+func icmpError(src net.IP, kind icmpErrorKind, p *probe, exts []icmp.Extension) ([]byte, error) {
+	quote := quoted(p)
+	m := icmp.Message{}
+	if p.v6() {
+		switch kind {
+		case errTimeExceeded:
+			m.Type, m.Body = ipv6.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote, Extensions: exts}
+		case errPortUnreachable:
+			m.Type, m.Code, m.Body = ipv6.ICMPTypeDestinationUnreachable, 4, &icmp.DstUnreach{Data: quote}
+		}
+		return m.Marshal(icmp.IPv6PseudoHeader(src, p.src))
+	}
+	switch kind {
+	case errTimeExceeded:
+		m.Type, m.Body = ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote, Extensions: exts}
+	case errPortUnreachable:
+		m.Type, m.Code, m.Body = ipv4.ICMPTypeDestinationUnreachable, 3, &icmp.DstUnreach{Data: quote}
+	}
+	return m.Marshal(nil)
+}
+
+// quoted returns p as an ICMP error quotes it: as much as fits in the
+// minimum MTU of the address family, 576 bytes for IPv4 as RFC 1812 allows
+// and 1280 for IPv6.
+func quoted(p *probe) []byte {
+	b := append(marshalHeader(p), p.payload...)
+	max := 576 - ipv4.HeaderLen - 8
+	if p.v6() {
+		max = 1280 - ipv6.HeaderLen - 8
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	return b
+}
+
+// unreachableError builds the Destination Unreachable of code src sends
+// about p.
+func unreachableError(src net.IP, p *probe, code int) ([]byte, error) {
+	if p.v6() {
+		m := icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: code, Body: &icmp.DstUnreach{Data: quoted(p)}}
+		return m.Marshal(icmp.IPv6PseudoHeader(src, p.src))
+	}
+	m := icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: code, Body: &icmp.DstUnreach{Data: quoted(p)}}
+	return m.Marshal(nil)
+}
+
+// tooBigError builds the Fragmentation Needed or Packet Too Big src sends
+// about p, with the next-hop mtu.
+func tooBigError(src net.IP, p *probe, mtu int) ([]byte, error) {
+	if p.v6() {
+		m := icmp.Message{Type: ipv6.ICMPTypePacketTooBig, Body: &icmp.PacketTooBig{MTU: mtu, Data: quoted(p)}}
+		return m.Marshal(icmp.IPv6PseudoHeader(src, p.src))
+	}
+	m := icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{Data: quoted(p)}}
+	b, err := m.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+	// icmp包不编码下一跳MTU，写进第6、7字节后重算校验和
+	binary.BigEndian.PutUint16(b[6:8], uint16(mtu))
+	b[2], b[3] = 0, 0
+	binary.BigEndian.PutUint16(b[2:4], checksum(b))
+	return b, nil
+}
+
+func echoReply(p *probe) []byte {
+	request, response := byte(ipv4.ICMPTypeEcho), byte(ipv4.ICMPTypeEchoReply)
+	if p.v6() {
+		request, response = byte(ipv6.ICMPTypeEchoRequest), byte(ipv6.ICMPTypeEchoReply)
+	}
+	if len(p.payload) < 8 || p.payload[0] != request {
+		return nil
+	}
+	b := append([]byte(nil), p.payload...)
+	b[0] = response
+	b[2], b[3] = 0, 0
+	if p.v6() {
+		binary.BigEndian.PutUint16(b[2:4], checksum(append(pseudoHeader(p.dst, p.src, protocolIPv6ICMP, len(b)), b...)))
+	} else {
+		binary.BigEndian.PutUint16(b[2:4], checksum(b))
+	}
+	return b
+}
+
+// tcpAnswer is the SYN-ACK or RST d answers the TCP probe p with. Its initial
+// sequence number is drawn from r, the seeded source of the network.
+func tcpAnswer(p *probe, d *Destination, r *rand.Rand) []byte {
+	if len(p.payload) < 20 || p.payload[13]&tcpFlagSYN == 0 {
+		return nil
+	}
+	sport := binary.BigEndian.Uint16(p.payload[0:2])
+	dport := binary.BigEndian.Uint16(p.payload[2:4])
+	seq := binary.BigEndian.Uint32(p.payload[4:8])
+
+	flags := byte(tcpFlagRST | tcpFlagACK)
+	for _, port := range d.OpenTCPPorts {
+		if port == dport {
+			flags = tcpFlagSYN | tcpFlagACK
+		}
+	}
+	if flags&tcpFlagRST != 0 && d.DropTCP {
+		return nil
+	}
+
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:2], dport)
+	binary.BigEndian.PutUint16(b[2:4], sport)
+	binary.BigEndian.PutUint32(b[4:8], r.Uint32())
+	binary.BigEndian.PutUint32(b[8:12], seq+1)
+	b[12] = 5 << 4
+	b[13] = flags
+	binary.BigEndian.PutUint16(b[14:16], 65535)
+	binary.BigEndian.PutUint16(b[16:18], checksum(append(pseudoHeader(p.dst, p.src, protocolTCP, len(b)), b...)))
+	return b
+}
+
+// firstFragment returns the first fragment of the IPv6 packet p that fits
+// in mtu: a Fragment header, whose next header is the protocol of p, and as
+// much of the payload as fits in multiples of 8 bytes.
+func firstFragment(p *probe, mtu int) *probe {
+	frag := *p
+	n := (mtu - ipv6.HeaderLen - 8) &^ 7
+	h := make([]byte, 8)
+	h[0] = byte(p.proto)
+	binary.BigEndian.PutUint16(h[2:4], 1) // offset 0, more fragments
+	binary.BigEndian.PutUint32(h[4:8], uint32(p.id))
+	frag.proto = protocolIPv6Fragment
+	frag.payload = append(h, p.payload[:n]...)
+	return &frag
+}
+
+// marshalHeader encodes the IP header of p in wire format regardless of the
+// host platform.
+func marshalHeader(p *probe) []byte {
+	if p.v6() {
+		b := make([]byte, ipv6.HeaderLen)
+		b[0] = byte(ipv6.Version<<4 | p.tos>>4)
+		b[1] = byte(p.tos << 4)
+		binary.BigEndian.PutUint16(b[4:6], uint16(len(p.payload)))
+		b[6] = byte(p.proto)
+		b[7] = byte(p.ttl)
+		copy(b[8:24], p.src.To16())
+		copy(b[24:40], p.dst.To16())
+		return b
+	}
+	b := make([]byte, ipv4.HeaderLen)
+	b[0] = byte(ipv4.Version<<4 | ipv4.HeaderLen>>2)
+	b[1] = byte(p.tos)
+	binary.BigEndian.PutUint16(b[2:4], uint16(ipv4.HeaderLen+len(p.payload)))
+	binary.BigEndian.PutUint16(b[4:6], uint16(p.id))
+	binary.BigEndian.PutUint16(b[6:8], uint16(p.flags)<<13)
+	b[8] = byte(p.ttl)
+	b[9] = byte(p.proto)
+	copy(b[12:16], p.src.To4())
+	copy(b[16:20], p.dst.To4())
+	binary.BigEndian.PutUint16(b[10:12], checksum(b))
+	return b
+}
+
+func pseudoHeader(src, dst net.IP, proto, length int) []byte {
+	if src.To4() == nil {
+		b := make([]byte, 40)
+		copy(b[0:16], src.To16())
+		copy(b[16:32], dst.To16())
+		binary.BigEndian.PutUint32(b[32:36], uint32(length))
+		b[39] = byte(proto)
+		return b
+	}
+	b := make([]byte, 12)
+	copy(b[0:4], src.To4())
+	copy(b[4:8], dst.To4())
+	b[9] = byte(proto)
+	binary.BigEndian.PutUint16(b[10:12], uint16(length))
+	return b
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) > 0 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
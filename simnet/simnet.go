@@ -0,0 +1,377 @@
+// Package simnet is an in-memory network of virtual routers that implements
+// ztrace.Transport, so that traces can run deterministically in tests
+// without raw sockets or network access.
+package simnet
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	ztrace "github.com/eaglesunshine/trace"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	routerInitialTTL = 255
+	hostInitialTTL   = 64
+)
+
+// Router is a virtual router answering expired probes with ICMP Time Exceeded.
+type Router struct {
+	Addr      string
+	Latency   time.Duration // round trip time from the source
+	Loss      float64       // probability that a reply is lost, 0 to 1
+	RateLimit float64       // ICMP errors per second, 0 is unlimited
+	Silent    bool          // never sends ICMP errors
+	// FilterTCPPorts are the TCP destination ports the router silently
+	// drops instead of forwarding, like a firewall.
+	FilterTCPPorts []uint16
+	// MPLS is the label stack the router quotes in an RFC 4950 extension
+	// of its Time Exceeded messages.
+	MPLS []ztrace.MPLSLabel
+	// InterfaceInfo are the RFC 5837 objects the router appends to its
+	// Time Exceeded messages. Name and MTU are only sent with an IfIndex.
+	InterfaceInfo []ztrace.InterfaceInfo
+	// MTU is the MTU of the link the router forwards on, 0 is unlimited.
+	// Larger IPv6 packets and IPv4 packets with DF set are answered with
+	// Packet Too Big or Fragmentation Needed, larger IPv4 packets without
+	// DF are fragmented and pass.
+	MTU int
+	// PMTUBlackHole drops the packets larger than MTU without an ICMP
+	// error, like a router whose errors are filtered.
+	PMTUBlackHole bool
+	// Reject answers the packets the router would forward with a
+	// Destination Unreachable of RejectCode, like a firewall rule that
+	// rejects them, e.g. code 13 for IPv4 or 1 for IPv6 when
+	// administratively prohibited. Expired packets still get Time Exceeded.
+	Reject     bool
+	RejectCode int
+	// Remark rewrites the TOS or traffic class of the packets the router
+	// forwards, e.g. to bleach DSCP or clear ECT, nil keeps it.
+	Remark func(tos int) int
+	// ReturnHops is the length of the path its replies take back, counting
+	// the router itself, default its hop index as if routing were symmetric.
+	ReturnHops int
+
+	limiter bucket
+}
+
+// Hop is one TTL of a path. With more than one router the hop is an ECMP
+// group and every flow is pinned to one member by hashing the addresses,
+// the protocol and the first four bytes of the transport header, the way
+// per-flow load balancers do.
+type Hop []*Router
+
+// Destination is the host at the end of a path. By default it answers ICMP
+// echo with Echo Reply, UDP with Port Unreachable and TCP SYN with RST.
+type Destination struct {
+	Addr         string
+	Latency      time.Duration
+	Loss         float64
+	DropICMP     bool     // discard ICMP echo requests
+	DropUDP      bool     // discard UDP probes instead of Port Unreachable
+	DropTCP      bool     // discard SYNs to ports not in OpenTCPPorts instead of RST
+	OpenTCPPorts []uint16 // ports answering SYN-ACK
+	ReturnHops   int      // hops its replies cross back, default the hops of the path plus one
+}
+
+// Path is the route from any source to Dest.Addr.
+type Path struct {
+	Hops []Hop
+	Dest Destination
+}
+
+// Network is the simulated network. Its zero value is not usable, call New.
+type Network struct {
+	// LocalMTU is the MTU of the link the source sends on, 0 is unlimited.
+	// Larger packets with DF set on IPv4 or DontFragment on IPv6 fail with
+	// EMSGSIZE, larger IPv6 packets without it leave as their first
+	// fragment, like the kernel fragments them. Set it before sending.
+	LocalMTU int
+
+	mu     sync.Mutex
+	paths  map[string]*Path
+	conns  map[*packetConn]struct{}
+	rand   *rand.Rand
+	probes int
+}
+
+// New returns an empty network; seed makes the loss decisions repeatable.
+func New(seed int64) *Network {
+	return &Network{
+		paths: make(map[string]*Path),
+		conns: make(map[*packetConn]struct{}),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// AddPath installs p as the route toward p.Dest.Addr.
+func (n *Network) AddPath(p Path) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.paths[net.ParseIP(p.Dest.Addr).String()] = &p
+}
+
+// Probes returns the number of probes the network has received.
+func (n *Network) Probes() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.probes
+}
+
+// probe is an IPv4 or IPv6 packet entering the network.
+type probe struct {
+	src     net.IP
+	dst     net.IP
+	ttl     int // TTL or hop limit
+	proto   int
+	tos     int // TOS or traffic class
+	id      int
+	flags   ipv4.HeaderFlags
+	payload []byte
+}
+
+func (p *probe) v6() bool {
+	return p.dst.To4() == nil
+}
+
+// size is the length of the IP packet.
+func (p *probe) size() int {
+	if p.v6() {
+		return ipv6.HeaderLen + len(p.payload)
+	}
+	return ipv4.HeaderLen + len(p.payload)
+}
+
+// reply is a packet delivered back to the listening conns.
+type reply struct {
+	src   net.IP
+	dst   net.IP
+	proto int
+	ttl   int
+	data  []byte
+}
+
+func (n *Network) send(p *probe) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.probes++
+
+	path, ok := n.paths[p.dst.String()]
+	if !ok || p.ttl <= 0 {
+		return
+	}
+	sent := p.ttl
+	arrived := *p
+	p = &arrived
+
+	for i, hop := range path.Hops {
+		if i >= sent-1 {
+			break
+		}
+		if len(hop) == 0 {
+			continue
+		}
+		r := hop[flowHash(p)%uint32(len(hop))]
+		if r.filters(p) {
+			return
+		}
+		if r.tooBig(p) {
+			arrived.ttl = sent - i
+			n.packetTooBig(r, i+1, p)
+			return
+		}
+		if r.Reject {
+			arrived.ttl = sent - i
+			n.reject(r, i+1, p)
+			return
+		}
+		if r.Remark != nil {
+			arrived.tos = r.Remark(arrived.tos)
+		}
+	}
+
+	if sent <= len(path.Hops) {
+		arrived.ttl = 1
+		hop := path.Hops[sent-1]
+		if len(hop) == 0 {
+			return
+		}
+		r := hop[flowHash(p)%uint32(len(hop))]
+		if r.Silent || n.lost(r.Loss) || !r.limiter.allow(r.RateLimit, time.Now()) {
+			return
+		}
+		src := net.ParseIP(r.Addr)
+		data, err := icmpError(src, errTimeExceeded, p, r.extensions())
+		if err != nil {
+			return
+		}
+		n.schedule(r.Latency, &reply{
+			src:   src,
+			dst:   p.src,
+			proto: icmpProtocol(p),
+			ttl:   replyTTL(routerInitialTTL, sent, r.ReturnHops),
+			data:  data,
+		})
+		return
+	}
+
+	arrived.ttl = sent - len(path.Hops)
+	d := &path.Dest
+	if n.lost(d.Loss) {
+		return
+	}
+	var data []byte
+	proto := icmpProtocol(p)
+	switch p.proto {
+	case protocolICMP, protocolIPv6ICMP:
+		if !d.DropICMP {
+			data = echoReply(p)
+		}
+	case protocolUDP:
+		if !d.DropUDP {
+			data, _ = icmpError(p.dst, errPortUnreachable, p, nil)
+		}
+	case protocolTCP:
+		data = tcpAnswer(p, d, n.rand)
+		proto = protocolTCP
+	}
+	if data == nil {
+		return
+	}
+	n.schedule(d.Latency, &reply{
+		src:   p.dst,
+		dst:   p.src,
+		proto: proto,
+		ttl:   replyTTL(hostInitialTTL, len(path.Hops)+1, d.ReturnHops),
+		data:  data,
+	})
+}
+
+// filters reports whether the router drops p instead of forwarding it.
+func (r *Router) filters(p *probe) bool {
+	if p.proto != protocolTCP || len(p.payload) < 4 {
+		return false
+	}
+	dport := binary.BigEndian.Uint16(p.payload[2:4])
+	for _, port := range r.FilterTCPPorts {
+		if port == dport {
+			return true
+		}
+	}
+	return false
+}
+
+// tooBig reports whether p is too big for the link the router forwards on
+// and may not be fragmented.
+func (r *Router) tooBig(p *probe) bool {
+	return r.MTU > 0 && p.size() > r.MTU && (p.v6() || p.flags&ipv4.DontFragment != 0)
+}
+
+// packetTooBig answers p, too big for the link of r at hop, unless r drops
+// it silently; the network lock is held.
+func (n *Network) packetTooBig(r *Router, hop int, p *probe) {
+	if r.Silent || r.PMTUBlackHole || n.lost(r.Loss) || !r.limiter.allow(r.RateLimit, time.Now()) {
+		return
+	}
+	src := net.ParseIP(r.Addr)
+	data, err := tooBigError(src, p, r.MTU)
+	if err != nil {
+		return
+	}
+	n.schedule(r.Latency, &reply{
+		src:   src,
+		dst:   p.src,
+		proto: icmpProtocol(p),
+		ttl:   replyTTL(routerInitialTTL, hop, r.ReturnHops),
+		data:  data,
+	})
+}
+
+// reject answers p with the Destination Unreachable of r at hop index hop.
+func (n *Network) reject(r *Router, hop int, p *probe) {
+	if r.Silent || n.lost(r.Loss) || !r.limiter.allow(r.RateLimit, time.Now()) {
+		return
+	}
+	src := net.ParseIP(r.Addr)
+	data, err := unreachableError(src, p, r.RejectCode)
+	if err != nil {
+		return
+	}
+	n.schedule(r.Latency, &reply{
+		src:   src,
+		dst:   p.src,
+		proto: icmpProtocol(p),
+		ttl:   replyTTL(routerInitialTTL, hop, r.ReturnHops),
+		data:  data,
+	})
+}
+
+// replyTTL is the TTL a reply sent with initial arrives with from hop index
+// hop, or from returnHops away when set.
+func replyTTL(initial, hop, returnHops int) int {
+	if returnHops > 0 {
+		hop = returnHops
+	}
+	return initial - hop + 1
+}
+
+func (n *Network) lost(loss float64) bool {
+	return loss > 0 && n.rand.Float64() < loss
+}
+
+func (n *Network) schedule(delay time.Duration, r *reply) {
+	time.AfterFunc(delay, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for c := range n.conns {
+			c.deliver(r)
+		}
+	})
+}
+
+func flowHash(p *probe) uint32 {
+	h := fnv.New32a()
+	h.Write(p.src.To16())
+	h.Write(p.dst.To16())
+	h.Write([]byte{byte(p.proto)})
+	if len(p.payload) >= 4 {
+		h.Write(p.payload[:4])
+	}
+	return h.Sum32()
+}
+
+// bucket is a token bucket refilled at rate tokens per second.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) allow(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,1540 @@
+package simnet
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ztrace "github.com/eaglesunshine/trace"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	testSrc = "192.0.2.1"
+	testDst = "198.51.100.1"
+)
+
+func testPath() Path {
+	return Path{
+		Hops: []Hop{
+			{{Addr: "10.0.0.1", Latency: 1 * time.Millisecond}},
+			{{Addr: "10.0.1.1", Latency: 5 * time.Millisecond}, {Addr: "10.0.1.2", Latency: 6 * time.Millisecond}},
+			{{Addr: "10.0.2.1", Silent: true}},
+			{{Addr: "10.0.3.1", Latency: 20 * time.Millisecond}},
+		},
+		Dest: Destination{Addr: testDst, Latency: 25 * time.Millisecond},
+	}
+}
+
+func newTrace(t *testing.T, n *Network, protocol string) *ztrace.TraceRoute {
+	t.Helper()
+	tr, err := ztrace.NewWithConfig(ztrace.Config{
+		Protocol:  protocol,
+		Dest:      testDst,
+		Src:       testSrc,
+		Count:     3,
+		Interval:  50 * time.Millisecond,
+		Timeout:   300 * time.Millisecond,
+		MaxTTL:    8,
+		Transport: n,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestTraceICMP(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath())
+	tr := newTrace(t, n, "icmp")
+
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.LastHop != 5 {
+		t.Fatalf("LastHop = %d, want 5\n%s", tr.LastHop, tr.HopStr)
+	}
+	want := map[int][]string{
+		1: {"10.0.0.1"},
+		2: {"10.0.1.1", "10.0.1.2"},
+		3: {"???"},
+		4: {"10.0.3.1"},
+		5: {testDst},
+	}
+	if len(tr.HopDetail) != len(want) {
+		t.Fatalf("got %d hops, want %d\n%s", len(tr.HopDetail), len(want), tr.HopStr)
+	}
+	for _, hop := range tr.HopDetail {
+		if !contains(want[hop.Index], hop.Host) {
+			t.Errorf("hop %d host = %s, want one of %v", hop.Index, hop.Host, want[hop.Index])
+		}
+	}
+	if hop := tr.HopDetail[3]; hop.Loss != 0 || hop.Avg < 20 {
+		t.Errorf("hop 4 = %+v, want no loss and avg >= 20ms", hop)
+	}
+}
+
+func TestTraceUDPAndTCP(t *testing.T) {
+	for _, protocol := range []string{"udp", "tcp"} {
+		n := New(1)
+		n.AddPath(testPath())
+		tr := newTrace(t, n, protocol)
+
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[int][]string{
+			1: {"10.0.0.1"},
+			2: {"10.0.1.1", "10.0.1.2"},
+			3: {"???"},
+			4: {"10.0.3.1"},
+			5: {testDst},
+		}
+		if len(tr.HopDetail) != len(want) {
+			t.Fatalf("%s: got %d hops, want %d\n%s", protocol, len(tr.HopDetail), len(want), tr.HopStr)
+		}
+		for _, hop := range tr.HopDetail {
+			if !contains(want[hop.Index], hop.Host) {
+				t.Errorf("%s: hop %d host = %s, want one of %v", protocol, hop.Index, hop.Host, want[hop.Index])
+			}
+		}
+		if hop := tr.Result().Hops[0]; hop.Sent != tr.Count || hop.Received != tr.Count {
+			t.Errorf("%s: hop 1 sent %d received %d, want %d", protocol, hop.Sent, hop.Received, tr.Count)
+		}
+	}
+}
+
+func TestTCPPortState(t *testing.T) {
+	for port, want := range map[uint16]ztrace.TCPPortState{443: ztrace.TCPPortOpen, 80: ztrace.TCPPortClosed} {
+		r := &recorder{Network: New(1)}
+		p := testPath()
+		p.Dest.OpenTCPPorts = []uint16{443}
+		r.AddPath(p)
+		tr := newTrace(t, r.Network, "tcp")
+		tr.Transport = r
+		tr.TCPDPort = port
+
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if hop := tr.HopDetail[len(tr.HopDetail)-1]; hop.Host != testDst || hop.Loss != 0 {
+			t.Errorf("port %d: destination hop = %+v", port, hop)
+		}
+		if got := tr.Result().TCPPortState; got != want {
+			t.Errorf("port %d: state = %q, want %q", port, got, want)
+		}
+
+		// SYN-ACKs are answered with a RST carrying the sequence number the
+		// destination expects: the one after the SYN's.
+		syns := make(map[uint32]bool)
+		rsts := 0
+		for _, b := range r.probes {
+			seq := binary.BigEndian.Uint32(b[4:8])
+			switch {
+			case b[13]&ztrace.TCP_SYN != 0:
+				syns[seq] = true
+			case b[13]&ztrace.TCP_RST != 0:
+				if !syns[seq-1] {
+					t.Errorf("port %d: RST seq %d answers no SYN", port, seq)
+				}
+				rsts++
+			}
+		}
+		if want == ztrace.TCPPortOpen && rsts < tr.Count {
+			t.Errorf("port %d: sent %d RSTs, want at least %d", port, rsts, tr.Count)
+		}
+		if want == ztrace.TCPPortClosed && rsts != 0 {
+			t.Errorf("port %d: sent %d RSTs to a closed port", port, rsts)
+		}
+	}
+}
+
+func TestTCPMultiPort(t *testing.T) {
+	n := New(1)
+	p := testPath()
+	p.Hops[0][0].FilterTCPPorts = []uint16{8080}
+	p.Dest.OpenTCPPorts = []uint16{443}
+	p.Dest.DropTCP = true
+	n.AddPath(p)
+	tr, err := ztrace.NewWithConfig(ztrace.Config{
+		Protocol:      "tcp",
+		Dest:          testDst,
+		Src:           testSrc,
+		Count:         2,
+		Timeout:       300 * time.Millisecond,
+		MaxTTL:        8,
+		TCPProbePorts: []uint16{443, 8080, 8443},
+		TCPMultiPort:  true,
+		Transport:     n,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+	want := []ztrace.ResultTCPPort{
+		{Port: 443, State: ztrace.TCPPortOpen, LastTTL: 5, LastHop: testDst},
+		{Port: 8080, LastTTL: 1, LastHop: "10.0.0.1"},
+		{Port: 8443, LastTTL: 4, LastHop: "10.0.3.1"},
+	}
+	got := tr.Result().TCPPorts
+	if len(got) != len(want) {
+		t.Fatalf("got %d ports, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("port %d = %+v, want %+v", want[i].Port, got[i], want[i])
+		}
+	}
+	if hop := tr.Result().Hops[0]; hop.Sent != 3*tr.Count {
+		t.Errorf("hop 1 sent %d probes, want %d", hop.Sent, 3*tr.Count)
+	}
+	if !strings.Contains(tr.HopStr, "Port 8080") {
+		t.Errorf("missing port summary\n%s", tr.HopStr)
+	}
+}
+
+const (
+	testSrc6 = "2001:db8::2"
+	testDst6 = "2001:db8:ffff::1"
+)
+
+func testPath6() Path {
+	return Path{
+		Hops: []Hop{
+			{{Addr: "2001:db8:1::1", Latency: 1 * time.Millisecond}},
+			{{Addr: "2001:db8:2::1", Silent: true}},
+			{{Addr: "2001:db8:3::1", Latency: 10 * time.Millisecond}},
+		},
+		Dest: Destination{Addr: testDst6, Latency: 15 * time.Millisecond},
+	}
+}
+
+func newTrace6(t *testing.T, n *Network, protocol string) *ztrace.TraceRoute {
+	t.Helper()
+	tr, err := ztrace.NewWithConfig(ztrace.Config{
+		Protocol:  protocol,
+		Dest:      testDst6,
+		Src:       testSrc6,
+		Af:        "ip6",
+		Count:     3,
+		Interval:  50 * time.Millisecond,
+		Timeout:   300 * time.Millisecond,
+		MaxTTL:    8,
+		Transport: n,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestTraceIPv6ICMP(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath6())
+	tr := newTrace6(t, n, "icmp")
+
+	start := time.Now()
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// Probes are sent without waiting for each reply, so the whole trace
+	// takes about Count*Interval plus Timeout rather than a timeout per hop.
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("trace took %v", elapsed)
+	}
+
+	want := []string{"2001:db8:1::1", "???", "2001:db8:3::1", testDst6}
+	if len(tr.HopDetail) != len(want) {
+		t.Fatalf("got %d hops, want %d\n%s", len(tr.HopDetail), len(want), tr.HopStr)
+	}
+	for i, hop := range tr.HopDetail {
+		if hop.Host != want[i] {
+			t.Errorf("hop %d host = %s, want %s", hop.Index, hop.Host, want[i])
+		}
+	}
+	if len(tr.Hops) != len(want) || len(tr.Hops[0].Details) != 3 {
+		t.Errorf("Hops = %+v, want %d hops with 3 replies at hop 1", tr.Hops, len(want))
+	}
+	if r := tr.Result(); !r.Reached || r.AddressFamily != "ip6" || r.Hops[3].Sent != 3 {
+		t.Errorf("Result() = %+v", r)
+	}
+}
+
+func TestTraceIPv6UDP(t *testing.T) {
+	n := New(1)
+	path := testPath6()
+	path.Dest.DropICMP = true
+	n.AddPath(path)
+	tr := newTrace6(t, n, "udp")
+
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"2001:db8:1::1", "???", "2001:db8:3::1", testDst6}
+	if len(tr.HopDetail) != len(want) {
+		t.Fatalf("got %d hops, want %d\n%s", len(tr.HopDetail), len(want), tr.HopStr)
+	}
+	for i, hop := range tr.HopDetail {
+		if hop.Host != want[i] {
+			t.Errorf("hop %d host = %s, want %s", hop.Index, hop.Host, want[i])
+		}
+	}
+	last := tr.Result().Hops[3]
+	if last.Received != 3 || last.Samples[0].ICMPType != 1 || last.Samples[0].ICMPCode != 4 {
+		t.Errorf("destination hop = %+v, want 3 port unreachable replies", last)
+	}
+}
+
+func TestTraceIPv6TCP(t *testing.T) {
+	for _, port := range []uint16{443, 80} {
+		n := New(1)
+		path := testPath6()
+		// Replies faster than a few milliseconds can beat RecordSend when
+		// the tests run in parallel, and would then wait for Timeout.
+		path.Hops[0][0].Latency = 5 * time.Millisecond
+		path.Hops[1][0] = &Router{Addr: "2001:db8:2::1", Latency: 5 * time.Millisecond}
+		path.Dest.OpenTCPPorts = []uint16{443}
+		n.AddPath(path)
+		tr := newTrace6(t, n, "tcp")
+		tr.TCPDPort = port
+		tr.Timeout = 5 * time.Second
+
+		start := time.Now()
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+		// The SYN-ACK or RST of the destination ends the trace well before
+		// the probe timeout.
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("port %d: trace took %v", port, elapsed)
+		}
+		if len(tr.HopDetail) != 4 {
+			t.Fatalf("port %d: got %d hops, want 4\n%s", port, len(tr.HopDetail), tr.HopStr)
+		}
+		if hop := tr.HopDetail[3]; hop.Host != testDst6 || hop.Loss != 0 {
+			t.Errorf("port %d: destination hop = %+v", port, hop)
+		}
+		want := ztrace.TCPPortClosed
+		if port == 443 {
+			want = ztrace.TCPPortOpen
+		}
+		if got := tr.TCPPortState(port); got != want {
+			t.Errorf("port %d: state = %q, want %q", port, got, want)
+		}
+	}
+}
+
+func TestTraceLoss(t *testing.T) {
+	n := New(1)
+	p := testPath()
+	p.Hops[0][0].Loss = 1
+	p.Hops[3][0].RateLimit = 1
+	n.AddPath(p)
+	tr := newTrace(t, n, "icmp")
+
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if hop := tr.HopDetail[0]; hop.Host != "???" || hop.Loss != 100 {
+		t.Errorf("hop 1 = %+v, want lost", hop)
+	}
+	if hop := tr.HopDetail[3]; hop.Host != "10.0.3.1" || hop.Loss == 0 {
+		t.Errorf("hop 4 = %+v, want rate limited", hop)
+	}
+	// Unanswered probes count against the responder of their flow.
+	if r := tr.Result().Hops[3].Responders; len(r) != 1 || r[0].Sent != tr.Count || r[0].Received == tr.Count {
+		t.Errorf("hop 4 responders = %+v, want %d sent with loss", r, tr.Count)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	n := New(1)
+	p := testPath()
+	p.Dest.DropICMP = true
+	n.AddPath(p)
+	tr := newTrace(t, n, "icmp")
+	tr.Timeout = 10 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := tr.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("RunContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("RunContext returned after %v", d)
+	}
+	if len(tr.HopDetail) == 0 {
+		t.Error("no partial results")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSpan runs the traces concurrently and returns the time between their
+// first and last probes.
+func sendSpan(t *testing.T, traces ...*ztrace.TraceRoute) time.Duration {
+	t.Helper()
+	var mu sync.Mutex
+	var first, last time.Time
+	for _, tr := range traces {
+		tr.Observer = func(e ztrace.Event) {
+			if e.Type != ztrace.ProbeSent {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if first.IsZero() || e.Time.Before(first) {
+				first = e.Time
+			}
+			if e.Time.After(last) {
+				last = e.Time
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	for _, tr := range traces {
+		wg.Add(1)
+		go func(tr *ztrace.TraceRoute) {
+			defer wg.Done()
+			if err := tr.Run(); err != nil {
+				t.Error(err)
+			}
+		}(tr)
+	}
+	wg.Wait()
+	return last.Sub(first)
+}
+
+func TestPacketRate(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath())
+	tr := newTrace(t, n, "udp")
+	tr.MaxTTL = 5
+	tr.PacketRate = 50
+
+	// 15 probes at 50 per second need 280ms whatever the flows.
+	if span := sendSpan(t, tr); span < 250*time.Millisecond {
+		t.Errorf("%d probes sent in %v at 50 per second", n.Probes(), span)
+	}
+	if len(tr.HopDetail) != 5 || tr.HopDetail[4].Host != testDst {
+		t.Errorf("paced trace did not reach the destination\n%s", tr.HopStr)
+	}
+}
+
+func TestGlobalPacketRate(t *testing.T) {
+	ztrace.SetGlobalPacketRate(100)
+	defer ztrace.SetGlobalPacketRate(0)
+
+	n := New(1)
+	n.AddPath(testPath())
+	a, b := newTrace(t, n, "udp"), newTrace(t, n, "tcp")
+	a.MaxTTL, b.MaxTTL = 5, 5
+
+	// 30 probes of unlimited traces at 100 per second in all need 290ms.
+	if span := sendSpan(t, a, b); span < 250*time.Millisecond {
+		t.Errorf("%d probes sent in %v at 100 per second", n.Probes(), span)
+	}
+}
+
+func TestLossOverManyRounds(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath())
+	tr := newTrace(t, n, "icmp")
+	tr.Count = 12
+	tr.Interval = 10 * time.Millisecond
+
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if hop := tr.HopDetail[0]; hop.Loss != 0 || hop.Snt != tr.Count {
+		t.Errorf("hop 1 = %+v, want %d probes without loss", hop, tr.Count)
+	}
+}
+
+func TestContinuous(t *testing.T) {
+	for _, protocol := range []string{"icmp", "udp"} {
+		n := New(1)
+		n.AddPath(testPath())
+		tr, err := ztrace.NewWithConfig(ztrace.Config{
+			Protocol:         protocol,
+			Dest:             testDst,
+			Src:              testSrc,
+			Count:            2,
+			Interval:         30 * time.Millisecond,
+			Timeout:          300 * time.Millisecond,
+			MaxTTL:           8,
+			Continuous:       true,
+			WindowCycles:     3,
+			SnapshotInterval: 100 * time.Millisecond,
+			Transport:        n,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		var snapshots []*ztrace.TraceResult
+		tr.Observer = func(e ztrace.Event) {
+			if e.Type == ztrace.Snapshot {
+				mu.Lock()
+				snapshots = append(snapshots, e.Snapshot)
+				mu.Unlock()
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+		err = tr.RunContext(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("%s: RunContext() = %v, want %v", protocol, err, context.DeadlineExceeded)
+		}
+
+		mu.Lock()
+		if len(snapshots) < 4 {
+			t.Fatalf("%s: got %d snapshots", protocol, len(snapshots))
+		}
+		last := snapshots[len(snapshots)-1]
+		mu.Unlock()
+		if !last.Reached || len(last.Hops) != 5 {
+			t.Errorf("%s: last snapshot has %d hops, reached %v", protocol, len(last.Hops), last.Reached)
+		}
+		// Well over 3 rounds went out, the stats only cover the last 3.
+		if n.Probes() < 6*tr.MaxTTL*tr.Count {
+			t.Errorf("%s: only %d probes sent", protocol, n.Probes())
+		}
+		hop := tr.Result().Hops[0]
+		if hop.Sent > 3*tr.Count || hop.Sent < tr.Count || hop.LossPct != 0 {
+			t.Errorf("%s: hop 1 sent %d lost %v%%, want at most %d probes of the window", protocol, hop.Sent, hop.LossPct, 3*tr.Count)
+		}
+		for _, s := range hop.Samples {
+			if s.Cycle < 3 {
+				t.Errorf("%s: sample of round %d left in the window", protocol, s.Cycle)
+			}
+		}
+		if !strings.Contains(tr.Report(), "10.0.3.1") {
+			t.Errorf("%s: report misses hop 4\n%s", protocol, tr.Report())
+		}
+	}
+}
+
+func TestContinuousLongerRoute(t *testing.T) {
+	path := func(hops int) Path {
+		p := Path{Dest: Destination{Addr: testDst, Latency: 10 * time.Millisecond}}
+		for i := 1; i <= hops; i++ {
+			p.Hops = append(p.Hops, Hop{{Addr: fmt.Sprintf("10.0.%d.1", i), Latency: 5 * time.Millisecond}})
+		}
+		return p
+	}
+	for _, protocol := range []string{"icmp", "udp"} {
+		n := New(1)
+		n.AddPath(path(2))
+		tr, err := ztrace.NewWithConfig(ztrace.Config{
+			Protocol:     protocol,
+			Dest:         testDst,
+			Src:          testSrc,
+			Count:        2,
+			Interval:     30 * time.Millisecond,
+			Timeout:      300 * time.Millisecond,
+			MaxTTL:       8,
+			Continuous:   true,
+			WindowCycles: 3,
+			Transport:    n,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 路径中途变长，之后的轮次要探测到新的终点
+		time.AfterFunc(300*time.Millisecond, func() { n.AddPath(path(4)) })
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = tr.RunContext(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("%s: RunContext() = %v, want %v", protocol, err, context.DeadlineExceeded)
+		}
+
+		r := tr.Result()
+		if !r.Reached || len(r.Hops) != 5 || r.Hops[2].Addr != "10.0.3.1" {
+			t.Errorf("%s: reached %v with %d hops after the route got longer\n%s", protocol, r.Reached, len(r.Hops), tr.Report())
+		}
+	}
+}
+
+func TestEarlyCompletion(t *testing.T) {
+	for _, protocol := range []string{"icmp", "udp", "tcp"} {
+		n := New(1)
+		p := testPath()
+		p.Hops[0][0].Latency = 5 * time.Millisecond
+		p.Hops[2][0] = &Router{Addr: "10.0.2.1", Latency: 10 * time.Millisecond}
+		n.AddPath(p)
+		tr := newTrace(t, n, protocol)
+		tr.Timeout = 5 * time.Second
+
+		start := time.Now()
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+		// The destination answered every flow and every hop before it
+		// answered, so nothing is left to wait for.
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: trace took %v", protocol, elapsed)
+		}
+		if len(tr.HopDetail) != 5 || tr.HopDetail[4].Host != testDst || tr.HopDetail[4].Loss != 0 {
+			t.Errorf("%s: trace did not reach the destination\n%s", protocol, tr.HopStr)
+		}
+	}
+}
+
+func TestEarlyCompletionManyFlows(t *testing.T) {
+	for _, protocol := range []string{"udp", "tcp"} {
+		n := New(1)
+		n.AddPath(Path{
+			Hops: []Hop{{{Addr: "10.0.0.1", Latency: 5 * time.Millisecond}}},
+			Dest: Destination{Addr: testDst, Latency: 10 * time.Millisecond},
+		})
+		tr := newTrace(t, n, protocol)
+		tr.Timeout = 5 * time.Second
+		// 32条流从500个源端口里随机选，不去重的话多半会撞上
+		tr.Count = 32
+
+		start := time.Now()
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: trace took %v", protocol, elapsed)
+		}
+	}
+}
+
+func TestGapLimit(t *testing.T) {
+	n := New(1)
+	p := Path{
+		Hops: []Hop{
+			{{Addr: "10.0.0.1", Latency: 5 * time.Millisecond}},
+			{{Addr: "10.0.1.1", Latency: 5 * time.Millisecond}},
+		},
+		Dest: Destination{Addr: testDst, DropICMP: true},
+	}
+	for i := 0; i < 8; i++ {
+		p.Hops = append(p.Hops, Hop{{Addr: fmt.Sprintf("10.0.%d.1", i+2), Silent: true}})
+	}
+	n.AddPath(p)
+	tr := newTrace(t, n, "icmp")
+	tr.MaxTTL = 12
+	tr.GapLimit = 3
+	tr.Interval = 400 * time.Millisecond
+
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// The first round probes every TTL, the later ones stop at the end of
+	// the gap: 12 + 2*5 probes.
+	if got, want := n.Probes(), tr.MaxTTL+2*5; got != want {
+		t.Errorf("sent %d probes, want %d", got, want)
+	}
+	if len(tr.HopDetail) != 3 || tr.HopDetail[1].Host != "10.0.1.1" {
+		t.Errorf("unexpected hops\n%s", tr.HopStr)
+	}
+}
+
+func TestFirstTTLAndLongPath(t *testing.T) {
+	n := New(1)
+	var p Path
+	for i := 0; i < 200; i++ {
+		p.Hops = append(p.Hops, Hop{{Addr: fmt.Sprintf("10.%d.%d.1", i/250, i%250), Latency: 5 * time.Millisecond}})
+	}
+	p.Dest = Destination{Addr: testDst, Latency: 10 * time.Millisecond}
+	n.AddPath(p)
+	tr, err := ztrace.NewWithConfig(ztrace.Config{
+		Protocol:  "udp",
+		Dest:      testDst,
+		Src:       testSrc,
+		Count:     2,
+		Timeout:   300 * time.Millisecond,
+		FirstTTL:  3,
+		MaxTTL:    255,
+		Transport: n,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tr.HopDetail), 199; got != want {
+		t.Fatalf("got %d hops, want %d", got, want)
+	}
+	if first := tr.HopDetail[0]; first.Index != 3 || first.Host != "10.0.2.1" {
+		t.Errorf("first hop = %+v, want TTL 3", first)
+	}
+	if last := tr.HopDetail[len(tr.HopDetail)-1]; last.Index != 201 || last.Host != testDst {
+		t.Errorf("last hop = %+v, want the destination at TTL 201", last)
+	}
+	r := tr.Result()
+	if len(r.Hops) != 199 || r.Hops[0].TTL != 3 || !r.Reached {
+		t.Errorf("result has %d hops from TTL %d, reached %v", len(r.Hops), r.Hops[0].TTL, r.Reached)
+	}
+}
+
+func TestTTLConfig(t *testing.T) {
+	for _, c := range []struct {
+		first, max int
+		field      string
+	}{
+		{0, 256, "MaxTTL"},
+		{31, 30, "FirstTTL"},
+		{-1, 30, "FirstTTL"},
+	} {
+		_, err := ztrace.NewWithConfig(ztrace.Config{Dest: testDst, FirstTTL: c.first, MaxTTL: c.max, Transport: New(1)})
+		if e, ok := err.(*ztrace.ConfigError); !ok || e.Field != c.field {
+			t.Errorf("FirstTTL %d MaxTTL %d: err = %v, want invalid %s", c.first, c.max, err, c.field)
+		}
+	}
+}
+
+func TestMPLS(t *testing.T) {
+	stack := []ztrace.MPLSLabel{{Label: 24001, TTL: 1}, {Label: 16, TC: 5, S: true, TTL: 1}}
+	for _, af := range []string{"ip4", "ip6"} {
+		for _, protocol := range []string{"icmp", "udp", "tcp"} {
+			n := New(1)
+			var hops []Hop
+			for i := 1; i <= 3; i++ {
+				r := &Router{Addr: fmt.Sprintf("10.0.%d.1", i), Latency: 5 * time.Millisecond}
+				if af == "ip6" {
+					r.Addr = fmt.Sprintf("2001:db8:%d::1", i)
+				}
+				if i == 2 {
+					r.MPLS = stack
+				}
+				hops = append(hops, Hop{r})
+			}
+			dst := Destination{Addr: testDst, Latency: 10 * time.Millisecond}
+			if af == "ip6" {
+				dst.Addr = testDst6
+			}
+			n.AddPath(Path{Hops: hops, Dest: dst})
+			tr := newTrace(t, n, protocol)
+			if af == "ip6" {
+				tr = newTrace6(t, n, protocol)
+			}
+			if err := tr.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := tr.Result()
+			if len(r.Hops) != 4 {
+				t.Fatalf("%s %s: %d hops, want 4", af, protocol, len(r.Hops))
+			}
+			if got := r.Hops[1].MPLS; fmt.Sprint(got) != fmt.Sprint(stack) {
+				t.Errorf("%s %s: hop 2 labels = %v, want %v", af, protocol, got, stack)
+			}
+			for _, s := range r.Hops[1].Samples {
+				if s.Received && len(s.MPLS) != len(stack) {
+					t.Errorf("%s %s: sample %+v, want the label stack", af, protocol, s)
+				}
+			}
+			for _, i := range []int{0, 2, 3} {
+				if r.Hops[i].MPLS != nil {
+					t.Errorf("%s %s: hop %d labels = %v, want none", af, protocol, i+1, r.Hops[i].MPLS)
+				}
+			}
+			if want := "<MPLS:L=24001,E=0,S=0,T=1/L=16,E=5,S=1,T=1>"; !strings.Contains(tr.HopStr, want) {
+				t.Errorf("%s %s: report does not show %s\n%s", af, protocol, want, tr.HopStr)
+			}
+		}
+	}
+}
+
+func TestInterfaceInfo(t *testing.T) {
+	for _, af := range []string{"ip4", "ip6"} {
+		for _, protocol := range []string{"icmp", "udp", "tcp"} {
+			in := ztrace.InterfaceInfo{Role: ztrace.InterfaceIncoming, IfIndex: 12, Addr: "172.16.0.1", Name: "ae3.0", MTU: 9000}
+			dst := Destination{Addr: testDst, Latency: 10 * time.Millisecond}
+			if af == "ip6" {
+				in.Addr = "2001:db8:ff::1"
+				dst.Addr = testDst6
+			}
+			out := ztrace.InterfaceInfo{Role: ztrace.InterfaceOutgoing, IfIndex: 7, Name: "xe-0/0/1"}
+			r := &Router{
+				Addr:          "10.0.0.1",
+				Latency:       5 * time.Millisecond,
+				MPLS:          []ztrace.MPLSLabel{{Label: 24001, S: true, TTL: 1}},
+				InterfaceInfo: []ztrace.InterfaceInfo{in, out},
+			}
+			if af == "ip6" {
+				r.Addr = "2001:db8:1::1"
+			}
+			n := New(1)
+			n.AddPath(Path{Hops: []Hop{{r}}, Dest: dst})
+			tr := newTrace(t, n, protocol)
+			if af == "ip6" {
+				tr = newTrace6(t, n, protocol)
+			}
+			if err := tr.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			hop := tr.Result().Hops[0]
+			if got, want := fmt.Sprint(hop.InterfaceInfo), fmt.Sprint([]ztrace.InterfaceInfo{in, out}); got != want {
+				t.Errorf("%s %s: hop 1 interfaces = %v, want %v", af, protocol, got, want)
+			}
+			if len(hop.MPLS) != 1 {
+				t.Errorf("%s %s: hop 1 labels = %v, want the label next to the interfaces", af, protocol, hop.MPLS)
+			}
+			for _, want := range []string{"<IN:ae3.0,ifindex=12,addr=" + in.Addr + ",mtu=9000>", "<OUT:xe-0/0/1,ifindex=7>"} {
+				if !strings.Contains(tr.HopStr, want) {
+					t.Errorf("%s %s: report does not show %s\n%s", af, protocol, want, tr.HopStr)
+				}
+			}
+		}
+	}
+}
+
+func TestPMTU(t *testing.T) {
+	for _, af := range []string{"ip4", "ip6"} {
+		addr := func(i int) string { return fmt.Sprintf("10.0.%d.1", i) }
+		dst, src := testDst, testSrc
+		if af == "ip6" {
+			addr = func(i int) string { return fmt.Sprintf("2001:db8:%d::1", i+1) }
+			dst, src = testDst6, testSrc6
+		}
+		n := New(1)
+		n.AddPath(Path{
+			Hops: []Hop{
+				{{Addr: addr(0), Latency: 5 * time.Millisecond, MTU: 1400}},
+				{{Addr: addr(1), Latency: 5 * time.Millisecond, MTU: 1300, PMTUBlackHole: true}},
+				{{Addr: addr(2), Latency: 5 * time.Millisecond}},
+			},
+			Dest: Destination{Addr: dst, Latency: 10 * time.Millisecond},
+		})
+		tr, err := ztrace.NewWithConfig(ztrace.Config{
+			Protocol:  "udp",
+			Dest:      dst,
+			Src:       src,
+			Af:        af,
+			Timeout:   300 * time.Millisecond,
+			MaxTTL:    8,
+			PMTU:      true,
+			Transport: n,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := tr.Result()
+		if !r.Reached || r.PMTU == nil || r.PMTU.MTU != 1300 {
+			t.Fatalf("%s: reached %v, pmtu %+v, want path MTU 1300", af, r.Reached, r.PMTU)
+		}
+		want := []ztrace.ResultMTUDrop{
+			{TTL: 2, Addr: addr(0), MTU: 1400},
+			{TTL: 3, MTU: 1300, BlackHole: true},
+		}
+		if fmt.Sprint(r.PMTU.Drops) != fmt.Sprint(want) {
+			t.Errorf("%s: drops = %+v, want %+v", af, r.PMTU.Drops, want)
+		}
+		// 太大而重发的探测不算这一跳的
+		if hop := r.Hops[1]; hop.Sent != 3 || hop.Received != 3 {
+			t.Errorf("%s: hop 2 sent %d received %d, want 3 and 3", af, hop.Sent, hop.Received)
+		}
+		if !strings.Contains(tr.HopStr, "Path MTU: 1300") || !strings.Contains(tr.HopStr, "black hole") {
+			t.Errorf("%s: report does not show the path MTU\n%s", af, tr.HopStr)
+		}
+	}
+
+	_, err := ztrace.NewWithConfig(ztrace.Config{Dest: testDst, PMTU: true, Transport: New(1)})
+	if e, ok := err.(*ztrace.ConfigError); !ok || e.Field != "PMTU" {
+		t.Errorf("PMTU with ICMP probes: err = %v, want invalid PMTU", err)
+	}
+	_, err = ztrace.NewWithConfig(ztrace.Config{Protocol: "udp", Dest: testDst6, Af: "ip6", PMTU: true, MTU: 1000, Transport: New(1)})
+	if e, ok := err.(*ztrace.ConfigError); !ok || e.Field != "MTU" {
+		t.Errorf("IPv6 MTU below 1280: err = %v, want invalid MTU", err)
+	}
+}
+
+func TestPMTULocalLink(t *testing.T) {
+	for _, af := range []string{"ip4", "ip6"} {
+		addr := func(i int) string { return fmt.Sprintf("10.0.%d.1", i) }
+		dst, src := testDst, testSrc
+		if af == "ip6" {
+			addr = func(i int) string { return fmt.Sprintf("2001:db8:%d::1", i+1) }
+			dst, src = testDst6, testSrc6
+		}
+		n := New(1)
+		// 本地链路的MTU比探测的起始大小小，要在发送时就发现
+		n.LocalMTU = 1400
+		n.AddPath(Path{
+			Hops: []Hop{
+				{{Addr: addr(0), Latency: 5 * time.Millisecond}},
+				{{Addr: addr(1), Latency: 5 * time.Millisecond}},
+			},
+			Dest: Destination{Addr: dst, Latency: 10 * time.Millisecond},
+		})
+		tr, err := ztrace.NewWithConfig(ztrace.Config{
+			Protocol:  "udp",
+			Dest:      dst,
+			Src:       src,
+			Af:        af,
+			Timeout:   300 * time.Millisecond,
+			MaxTTL:    8,
+			PMTU:      true,
+			Transport: n,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := tr.Result()
+		if !r.Reached || r.PMTU == nil || r.PMTU.MTU != 1400 {
+			t.Fatalf("%s: reached %v, pmtu %+v, want path MTU 1400", af, r.Reached, r.PMTU)
+		}
+		for _, d := range r.PMTU.Drops {
+			if d.TTL != 0 || d.BlackHole {
+				t.Errorf("%s: drop %+v, want the local link only", af, d)
+			}
+		}
+		for _, hop := range r.Hops {
+			if hop.Received != hop.Sent {
+				t.Errorf("%s: hop %d sent %d received %d", af, hop.TTL, hop.Sent, hop.Received)
+			}
+		}
+	}
+}
+
+func TestReplyTTL(t *testing.T) {
+	for _, af := range []string{"ip4", "ip6"} {
+		for _, protocol := range []string{"icmp", "udp", "tcp"} {
+			n := New(1)
+			var hops []Hop
+			for i := 1; i <= 4; i++ {
+				r := &Router{Addr: fmt.Sprintf("10.0.%d.1", i), Latency: 5 * time.Millisecond}
+				if af == "ip6" {
+					r.Addr = fmt.Sprintf("2001:db8:%d::1", i)
+				}
+				if i == 2 {
+					r.ReturnHops = 8
+				}
+				hops = append(hops, Hop{r})
+			}
+			dst := Destination{Addr: testDst, Latency: 10 * time.Millisecond}
+			if af == "ip6" {
+				dst.Addr = testDst6
+			}
+			n.AddPath(Path{Hops: hops, Dest: dst})
+			tr := newTrace(t, n, protocol)
+			if af == "ip6" {
+				tr = newTrace6(t, n, protocol)
+			}
+			if err := tr.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := tr.Result()
+			if len(r.Hops) != 5 {
+				t.Fatalf("%s %s: %d hops, want 5", af, protocol, len(r.Hops))
+			}
+			for i, hop := range r.Hops {
+				want := ztrace.ReplyPath{ReplyTTL: 256 - hop.TTL, InitialTTL: 255, ReturnHops: hop.TTL}
+				switch hop.TTL {
+				case 2:
+					want = ztrace.ReplyPath{ReplyTTL: 248, InitialTTL: 255, ReturnHops: 8, Asymmetric: true}
+				case 5:
+					want = ztrace.ReplyPath{ReplyTTL: 60, InitialTTL: 64, ReturnHops: 5}
+				}
+				if hop.ReplyPath != want || hop.Responders[0].ReplyPath != want {
+					t.Errorf("%s %s: hop %d reply path = %+v, want %+v", af, protocol, i+1, hop.ReplyPath, want)
+				}
+			}
+			if want := "<ASYM:return 8 hops,forward 2>"; !strings.Contains(tr.HopStr, want) || strings.Count(tr.HopStr, "<ASYM") != 1 {
+				t.Errorf("%s %s: report does not flag hop 2 alone with %s\n%s", af, protocol, want, tr.HopStr)
+			}
+		}
+	}
+}
+
+func TestTOSRemarking(t *testing.T) {
+	const sent = 46<<2 | 2 // EF, ECT(0)
+	for _, af := range []string{"ip4", "ip6"} {
+		for _, protocol := range []string{"icmp", "udp", "tcp"} {
+			n := New(1)
+			var hops []Hop
+			for i := 1; i <= 5; i++ {
+				r := &Router{Addr: fmt.Sprintf("10.0.%d.1", i), Latency: 5 * time.Millisecond}
+				if af == "ip6" {
+					r.Addr = fmt.Sprintf("2001:db8:%d::1", i)
+				}
+				switch i {
+				case 2:
+					r.Remark = func(tos int) int { return tos & 3 }
+				case 4:
+					r.Remark = func(tos int) int { return tos &^ 3 }
+				}
+				hops = append(hops, Hop{r})
+			}
+			dst := Destination{Addr: testDst, Latency: 10 * time.Millisecond}
+			if af == "ip6" {
+				dst.Addr = testDst6
+			}
+			n.AddPath(Path{Hops: hops, Dest: dst})
+			tr := newTrace(t, n, protocol)
+			if af == "ip6" {
+				tr = newTrace6(t, n, protocol)
+			}
+			tr.TOS = sent
+			if err := tr.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := tr.Result()
+			if len(r.Hops) != 6 {
+				t.Fatalf("%s %s: %d hops, want 6", af, protocol, len(r.Hops))
+			}
+			for i, want := range []int{sent, sent, 2, 2, 0} {
+				if got := r.Hops[i].QuotedTOS; got == nil || *got != want {
+					t.Errorf("%s %s: hop %d quoted TOS = %v, want %#x", af, protocol, i+1, got, want)
+				}
+			}
+			want := []ztrace.ResultTOSChange{
+				{TTL: 3, Addr: r.Hops[2].Addr, From: sent, To: 2},
+				{TTL: 5, Addr: r.Hops[4].Addr, From: 2, To: 0},
+			}
+			if fmt.Sprint(r.TOSChanges) != fmt.Sprint(want) {
+				t.Errorf("%s %s: TOS changes = %+v, want %+v", af, protocol, r.TOSChanges, want)
+			}
+			for _, line := range []string{"DSCP 46 -> 0 (bleached)", "ECN ECT(0) -> Not-ECT (ECT cleared)"} {
+				if !strings.Contains(tr.HopStr, line) {
+					t.Errorf("%s %s: report lacks %q\n%s", af, protocol, line, tr.HopStr)
+				}
+			}
+		}
+	}
+
+	_, err := ztrace.NewWithConfig(ztrace.Config{Dest: testDst, TOS: 256, Transport: New(1)})
+	if e, ok := err.(*ztrace.ConfigError); !ok || e.Field != "TOS" {
+		t.Errorf("TOS 256: err = %v, want invalid TOS", err)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	for _, c := range []struct {
+		af     string
+		code   int
+		marker string
+	}{
+		{"ip4", 13, "!X"},
+		{"ip4", 1, "!H"},
+		{"ip6", 1, "!X"},
+		{"ip6", 0, "!N"},
+	} {
+		for _, protocol := range []string{"icmp", "udp", "tcp"} {
+			n := New(1)
+			var hops []Hop
+			for i := 1; i <= 4; i++ {
+				r := &Router{Addr: fmt.Sprintf("10.0.%d.1", i), Latency: 5 * time.Millisecond}
+				if c.af == "ip6" {
+					r.Addr = fmt.Sprintf("2001:db8:%d::1", i)
+				}
+				if i == 2 {
+					r.Reject, r.RejectCode = true, c.code
+				}
+				hops = append(hops, Hop{r})
+			}
+			dst := Destination{Addr: testDst, Latency: 10 * time.Millisecond}
+			if c.af == "ip6" {
+				dst.Addr = testDst6
+			}
+			n.AddPath(Path{Hops: hops, Dest: dst})
+			tr := newTrace(t, n, protocol)
+			if c.af == "ip6" {
+				tr = newTrace6(t, n, protocol)
+			}
+			tr.Timeout = 5 * time.Second
+			// 快照在运行中生成Result，-race下能发现没加锁读Responders
+			tr.SnapshotInterval = time.Millisecond
+
+			start := time.Now()
+			if err := tr.Run(); err != nil {
+				t.Fatal(err)
+			}
+			// 第3跳回了不可达，后面的跳不用等超时
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("%s %s code %d: trace took %v", c.af, protocol, c.code, elapsed)
+			}
+
+			r := tr.Result()
+			if r.Reached || len(r.Hops) != 3 {
+				t.Fatalf("%s %s code %d: reached %v with %d hops, want 3 hops\n%s", c.af, protocol, c.code, r.Reached, len(r.Hops), tr.HopStr)
+			}
+			hop := r.Hops[2]
+			if hop.Addr != r.Hops[1].Addr || hop.Unreachable == nil || hop.Unreachable.Marker != c.marker || hop.Unreachable.Code != c.code {
+				t.Errorf("%s %s code %d: hop 3 = %v %+v, want %v from %v", c.af, protocol, c.code, hop.Addr, hop.Unreachable, c.marker, r.Hops[1].Addr)
+			}
+			if r.Hops[1].Unreachable != nil {
+				t.Errorf("%s %s code %d: hop 2 marked %v", c.af, protocol, c.code, r.Hops[1].Unreachable)
+			}
+			if !strings.Contains(tr.HopStr, c.marker) || len(tr.HopDetail) != 3 {
+				t.Errorf("%s %s code %d: report does not end at hop 3 with %s\n%s", c.af, protocol, c.code, c.marker, tr.HopStr)
+			}
+		}
+	}
+}
+
+func TestStatisticsDuringRun(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath())
+	tr := newTrace(t, n, "icmp")
+	// 运行中生成报告和Result都不能把还在路上的探测算成丢包
+	var mu sync.Mutex
+	var lossy []ztrace.ResultHop
+	tr.Observer = func(e ztrace.Event) {
+		if e.Type == ztrace.ProbeSent {
+			tr.Statistics()
+			for _, hop := range tr.Result().Hops {
+				if hop.Addr != "" && hop.LossPct != 0 {
+					mu.Lock()
+					lossy = append(lossy, hop)
+					mu.Unlock()
+				}
+			}
+		}
+	}
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, hop := range lossy {
+		t.Errorf("snapshot of hop %d: sent %d received %d lost %v%%", hop.TTL, hop.Sent, hop.Received, hop.LossPct)
+	}
+	r := tr.Result()
+	if !r.Reached || len(r.Hops) != 5 {
+		t.Fatalf("reached %v with %d hops\n%s", r.Reached, len(r.Hops), tr.HopStr)
+	}
+	for _, hop := range r.Hops {
+		if hop.Addr != "" && hop.LossPct != 0 {
+			t.Errorf("hop %d lost %v%%\n%s", hop.TTL, hop.LossPct, tr.HopStr)
+		}
+	}
+}
+
+func TestUnreachableOneBranch(t *testing.T) {
+	n := New(1)
+	n.AddPath(Path{
+		Hops: []Hop{
+			{{Addr: "10.0.0.1", Latency: 5 * time.Millisecond}},
+			{
+				{Addr: "10.0.1.1", Latency: 5 * time.Millisecond},
+				{Addr: "10.0.1.2", Latency: 5 * time.Millisecond, Reject: true, RejectCode: 13},
+			},
+			{{Addr: "10.0.2.1", Latency: 10 * time.Millisecond}},
+		},
+		Dest: Destination{Addr: testDst, Latency: 15 * time.Millisecond},
+	})
+	tr, err := ztrace.NewWithConfig(ztrace.Config{
+		Protocol:  "udp",
+		Dest:      testDst,
+		Src:       testSrc,
+		Timeout:   300 * time.Millisecond,
+		MaxTTL:    6,
+		MDA:       true,
+		Transport: n,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有一条ECMP支路被拒绝，其他flow仍然要探测到终点
+	r := tr.Result()
+	if !r.Reached || len(r.Hops) != 4 {
+		t.Fatalf("reached %v with %d hops\n%s", r.Reached, len(r.Hops), tr.HopStr)
+	}
+	var marked bool
+	for _, resp := range r.Hops[2].Responders {
+		if resp.Addr == "10.0.1.2" && resp.Unreachable != nil && resp.Unreachable.Marker == "!X" {
+			marked = true
+		}
+	}
+	if !marked {
+		t.Errorf("hop 3 responders %+v, want 10.0.1.2 marked !X", r.Hops[2].Responders)
+	}
+}
+
+func TestUnreachableTransient(t *testing.T) {
+	path := func(reject bool) Path {
+		p := Path{Dest: Destination{Addr: testDst, Latency: 10 * time.Millisecond}}
+		for i := 1; i <= 3; i++ {
+			p.Hops = append(p.Hops, Hop{{Addr: fmt.Sprintf("10.0.%d.1", i), Latency: 5 * time.Millisecond, Reject: reject && i == 2, RejectCode: 1}})
+		}
+		return p
+	}
+	n := New(1)
+	n.AddPath(path(true))
+	tr, err := ztrace.NewWithConfig(ztrace.Config{
+		Dest:         testDst,
+		Src:          testSrc,
+		Count:        1,
+		Interval:     30 * time.Millisecond,
+		Timeout:      300 * time.Millisecond,
+		MaxTTL:       8,
+		Continuous:   true,
+		WindowCycles: 3,
+		Transport:    n,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 持续模式下偶发的!H不能让之后的轮次一直停在这一跳
+	time.AfterFunc(300*time.Millisecond, func() { n.AddPath(path(false)) })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	err = tr.RunContext(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("RunContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	r := tr.Result()
+	if !r.Reached || len(r.Hops) != 4 {
+		t.Errorf("reached %v with %d hops after the !H went away\n%s", r.Reached, len(r.Hops), tr.Report())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath())
+	tr := newTrace(t, n, "icmp")
+
+	var mu sync.Mutex
+	counts := make(map[ztrace.EventType]int)
+	timedOut := make(map[int]bool)
+	tr.Observer = func(e ztrace.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts[e.Type]++
+		if e.Type == ztrace.ProbeTimedOut {
+			timedOut[e.TTL] = true
+		}
+	}
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := counts[ztrace.ProbeSent], n.Probes(); got != want {
+		t.Errorf("%d ProbeSent events, want %d", got, want)
+	}
+	if got := counts[ztrace.DestinationReached]; got != 1 {
+		t.Errorf("%d DestinationReached events, want 1", got)
+	}
+	if counts[ztrace.ReplyReceived] != counts[ztrace.HopUpdated] {
+		t.Errorf("%d ReplyReceived but %d HopUpdated events", counts[ztrace.ReplyReceived], counts[ztrace.HopUpdated])
+	}
+	if !timedOut[3] {
+		t.Error("no ProbeTimedOut event for the silent hop")
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	n := New(1)
+	n.AddPath(Path{
+		Hops: []Hop{
+			{{Addr: "10.0.0.1", Latency: 5 * time.Millisecond}},
+			{{Addr: "10.0.1.1", Latency: 350 * time.Millisecond}},
+		},
+		Dest: Destination{Addr: testDst, Latency: 10 * time.Millisecond},
+	})
+	// ICMP每轮间隔50ms，第一轮的迟到回复在运行结束前就会到
+	tr := newTrace(t, n, "icmp")
+
+	type probe struct {
+		flow string
+		id   uint32
+	}
+	var mu sync.Mutex
+	sent := make(map[probe]time.Time)
+	var waits []time.Duration
+	tr.Observer = func(e ztrace.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch e.Type {
+		case ztrace.ProbeSent:
+			sent[probe{e.FlowKey, e.ID}] = e.Time
+		case ztrace.ProbeTimedOut:
+			waits = append(waits, e.Time.Sub(sent[probe{e.FlowKey, e.ID}]))
+		}
+	}
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第2跳的回复在Timeout之后才到，要算丢包，而且超时事件要及时发出
+	mu.Lock()
+	defer mu.Unlock()
+	if len(waits) != tr.Count {
+		t.Errorf("%d ProbeTimedOut events, want %d", len(waits), tr.Count)
+	}
+	for _, d := range waits {
+		if d < tr.Timeout || d > tr.Timeout+150*time.Millisecond {
+			t.Errorf("ProbeTimedOut %v after the probe was sent, want about %v", d, tr.Timeout)
+		}
+	}
+	r := tr.Result()
+	if len(r.Hops) != 3 || r.Hops[1].Received != 0 || r.Hops[1].LossPct != 100 {
+		t.Errorf("late replies of hop 2 counted as received\n%s", tr.HopStr)
+	}
+}
+
+func TestResult(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath())
+	tr := newTrace(t, n, "icmp")
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(tr.Result())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r ztrace.TraceResult
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.SchemaVersion != ztrace.ResultSchemaVersion || !r.Reached || r.DestinationIP != testDst {
+		t.Fatalf("unexpected result %s", b)
+	}
+	if len(r.Hops) != 5 {
+		t.Fatalf("got %d hops, want 5", len(r.Hops))
+	}
+	for _, hop := range r.Hops {
+		if hop.Sent != tr.Count || len(hop.Samples) != tr.Count {
+			t.Errorf("hop %d: sent %d with %d samples, want %d", hop.TTL, hop.Sent, len(hop.Samples), tr.Count)
+		}
+	}
+	if hop := r.Hops[2]; hop.Addr != "" || hop.Received != 0 || hop.LossPct != 100 {
+		t.Errorf("silent hop = %+v", hop)
+	}
+	if hop := r.Hops[0]; hop.Addr != "10.0.0.1" || hop.Received != tr.Count || hop.Samples[0].RTTMs < 1 {
+		t.Errorf("hop 1 = %+v", hop)
+	}
+}
+
+// recorder is a Transport that keeps the transport payload of every probe
+// written through it.
+type recorder struct {
+	*Network
+	mu     sync.Mutex
+	probes [][]byte
+	ids    []int
+}
+
+func (r *recorder) record(b []byte, id int) {
+	r.mu.Lock()
+	r.probes = append(r.probes, append([]byte(nil), b...))
+	r.ids = append(r.ids, id)
+	r.mu.Unlock()
+}
+
+func (r *recorder) ListenPacket(network, address string) (ztrace.PacketConn, error) {
+	c, err := r.Network.ListenPacket(network, address)
+	return &recordedConn{c, r}, err
+}
+
+func (r *recorder) ListenRaw(network, address string) (ztrace.RawConn, error) {
+	c, err := r.Network.ListenRaw(network, address)
+	return &recordedRaw{c, r}, err
+}
+
+type recordedConn struct {
+	ztrace.PacketConn
+	r *recorder
+}
+
+func (c *recordedConn) WriteTo(b []byte, cm *ztrace.ControlMessage, dst net.Addr) (int, error) {
+	c.r.record(b, 0)
+	return c.PacketConn.WriteTo(b, cm, dst)
+}
+
+type recordedRaw struct {
+	ztrace.RawConn
+	r *recorder
+}
+
+func (c *recordedRaw) WriteTo(h *ipv4.Header, p []byte, cm *ipv4.ControlMessage) error {
+	c.r.record(p, h.ID)
+	return c.RawConn.WriteTo(h, p, cm)
+}
+
+func TestParis(t *testing.T) {
+	for _, protocol := range []string{"icmp", "udp"} {
+		r := &recorder{Network: New(1)}
+		r.AddPath(testPath())
+		tr := newTrace(t, r.Network, protocol)
+		tr.Transport = r
+		tr.Paris = true
+
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if len(tr.HopDetail) != 5 || tr.HopDetail[4].Host != testDst {
+			t.Fatalf("%s: trace did not reach the destination\n%s", protocol, tr.HopStr)
+		}
+		for _, hop := range tr.Result().Hops {
+			if hop.Addr != "" && hop.Received != tr.Count {
+				t.Errorf("%s: hop %d received %d replies, want %d", protocol, hop.TTL, hop.Received, tr.Count)
+			}
+		}
+
+		flows := make(map[string]bool)
+		for i, p := range r.probes {
+			switch protocol {
+			case "icmp":
+				// The checksum of a round, and so the flow, stays the same.
+				flows[fmt.Sprintf("%x", p[2:4])] = true
+			case "udp":
+				flows[fmt.Sprintf("%x", p[0:4])] = true
+				if sum := int(binary.BigEndian.Uint16(p[6:8])); sum != r.ids[i] {
+					t.Errorf("udp: probe %d checksum %#x, want ID %#x", i, sum, r.ids[i])
+				}
+			}
+		}
+		if len(flows) != tr.Count {
+			t.Errorf("%s: probes used %d flows, want %d", protocol, len(flows), tr.Count)
+		}
+	}
+}
+
+func TestParisIPv6UDP(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath6())
+	tr := newTrace6(t, n, "udp")
+	tr.Paris = true
+
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.HopDetail) != 4 || tr.HopDetail[3].Host != testDst6 || tr.HopDetail[3].Loss != 0 {
+		t.Fatalf("trace did not reach the destination\n%s", tr.HopStr)
+	}
+}
+
+func TestMDA(t *testing.T) {
+	for _, protocol := range []string{"udp", "tcp"} {
+		n := New(1)
+		n.AddPath(Path{
+			Hops: []Hop{
+				{{Addr: "10.0.0.1", Latency: 5 * time.Millisecond}},
+				{
+					{Addr: "10.0.1.1", Latency: 5 * time.Millisecond},
+					{Addr: "10.0.1.2", Latency: 5 * time.Millisecond},
+					{Addr: "10.0.1.3", Latency: 5 * time.Millisecond},
+					{Addr: "10.0.1.4", Latency: 5 * time.Millisecond},
+				},
+				{{Addr: "10.0.2.1", Latency: 10 * time.Millisecond}, {Addr: "10.0.2.2", Latency: 10 * time.Millisecond}},
+			},
+			Dest: Destination{Addr: testDst, Latency: 15 * time.Millisecond, OpenTCPPorts: []uint16{443}},
+		})
+		tr, err := ztrace.NewWithConfig(ztrace.Config{
+			Protocol:  protocol,
+			Dest:      testDst,
+			Src:       testSrc,
+			Timeout:   300 * time.Millisecond,
+			MaxTTL:    5,
+			MDA:       true,
+			Transport: n,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := tr.Result()
+		if len(r.Hops) < 3 {
+			t.Fatalf("%s: got %d hops, want at least 3", protocol, len(r.Hops))
+		}
+		// A single interface needs 6 flows at 95% confidence.
+		if hop := r.Hops[0]; hop.Sent != 6 || len(hop.Interfaces) != 1 {
+			t.Errorf("%s: hop 1 sent %d probes to %v", protocol, hop.Sent, hop.Interfaces)
+		}
+		if got := r.Hops[1].Interfaces; len(got) != 4 {
+			t.Errorf("%s: hop 2 interfaces = %v, want 4", protocol, got)
+		}
+		if got := r.Hops[2].Interfaces; len(got) != 2 {
+			t.Errorf("%s: hop 3 interfaces = %v, want 2", protocol, got)
+		}
+		links := 0
+		for _, l := range r.Links {
+			if l.TTL == 2 && l.From == "10.0.0.1" {
+				links++
+			}
+		}
+		if links != 4 {
+			t.Errorf("%s: %d links from hop 1 to hop 2, want 4: %v", protocol, links, r.Links)
+		}
+	}
+}
+
+func TestResponders(t *testing.T) {
+	n := New(1)
+	n.AddPath(testPath())
+	tr, err := ztrace.NewWithConfig(ztrace.Config{
+		Protocol:  "udp",
+		Dest:      testDst,
+		Src:       testSrc,
+		Timeout:   300 * time.Millisecond,
+		MaxTTL:    8,
+		MDA:       true,
+		Transport: n,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	hop := tr.Result().Hops[1]
+	if len(hop.Responders) != 2 {
+		t.Fatalf("hop 2 responders = %+v, want 2", hop.Responders)
+	}
+	sent := 0
+	for _, r := range hop.Responders {
+		sent += r.Sent
+		if r.Received != r.Sent || r.LossPct != 0 || r.AvgMs < 5 {
+			t.Errorf("responder %+v, want every probe answered after 5ms or more", r)
+		}
+		if !strings.Contains(tr.HopStr, r.Addr) {
+			t.Errorf("Statistics does not list %s\n%s", r.Addr, tr.HopStr)
+		}
+	}
+	if sent != hop.Sent {
+		t.Errorf("responders sent %d probes, hop sent %d", sent, hop.Sent)
+	}
+}
@@ -30,6 +30,149 @@ type ServerRecord struct {
 	AllTime         time.Duration
 	SuccSum         int64
 	Success         bool
+	SendCnt         uint64
+	LostCnt         uint64 // probes that timed out, Loss is over RecvCnt+LostCnt
+	Samples         []ProbeSample
+	// Responders are the addresses that answered probes with this TTL, in
+	// the order they first answered. Addr is the one that answered most.
+	Responders []*ResponderRecord
+
+	// flowResponder is the last responder of each flow, which unanswered
+	// probes of the flow are counted against.
+	flowResponder map[string]*ResponderRecord
+}
+
+// ResponderRecord holds the stats of one address answering at a TTL.
+type ResponderRecord struct {
+	Addr            string
+	SendCnt         uint64
+	RecvCnt         uint64
+	Loss            float64
+	LastTime        time.Duration
+	WrstTime        time.Duration
+	BestTime        time.Duration
+	AvgTime         time.Duration
+	AllTime         time.Duration
+	LatencyDescribe *describe.Item
+	Quantile        *quantile.Stream
+	MPLS            []MPLSLabel     // label stack of the last reply that quoted one
+	InterfaceInfo   []InterfaceInfo // RFC 5837 objects of the last reply that quoted any
+	ReplyTTL        int             // TTL the last reply arrived with, 0 when unknown
+	QuotedTOS       *int            // TOS of the probe quoted by the last ICMP error
+	Unreachable     *Unreachable    // last ICMP error that ends the path here
+}
+
+func newResponderRecord(addr string) *ResponderRecord {
+	return &ResponderRecord{
+		Addr:            addr,
+		LatencyDescribe: describe.New(),
+		Quantile:        quantile.NewTargeted(map[float64]float64{0.5: 0.05, 0.95: 0.01, 0.99: 0.001}),
+	}
+}
+
+func (r *ResponderRecord) recv(latency time.Duration) {
+	r.SendCnt++
+	r.RecvCnt++
+	r.LastTime = latency
+	if r.WrstTime == 0 || latency > r.WrstTime {
+		r.WrstTime = latency
+	}
+	if r.BestTime == 0 || latency < r.BestTime {
+		r.BestTime = latency
+	}
+	r.AllTime += latency
+	r.AvgTime = r.AllTime / time.Duration(r.RecvCnt)
+	r.LatencyDescribe.Append(Time2Float(latency), 2)
+	r.Quantile.Insert(Time2Float(latency))
+	r.updateLoss()
+}
+
+func (r *ResponderRecord) lost() {
+	r.SendCnt++
+	r.updateLoss()
+}
+
+func (r *ResponderRecord) updateLoss() {
+	r.Loss = 100 - float64(r.RecvCnt*100)/float64(r.SendCnt)
+}
+
+// recv records the reply of addr to a probe of flow; the caller holds
+// server.Lock.
+func (server *ServerRecord) recv(flow, addr string, latency time.Duration) {
+	resp := server.responder(addr)
+	resp.recv(latency)
+	if server.flowResponder == nil {
+		server.flowResponder = make(map[string]*ResponderRecord)
+	}
+	server.flowResponder[flow] = resp
+	server.Addr = server.primary().Addr
+	server.RecvCnt++
+	server.Success = true
+	server.SuccSum++
+	server.LastTime = latency
+	if server.WrstTime == time.Duration(0) || latency > server.WrstTime {
+		server.WrstTime = latency
+	}
+	if server.BestTime == time.Duration(0) || latency < server.BestTime {
+		server.BestTime = latency
+	}
+	server.AllTime += latency
+	server.AvgTime = server.AllTime / time.Duration(server.RecvCnt)
+	server.updateLoss()
+}
+
+// lost records a probe of flow that timed out, counted against the last
+// responder of the flow; the caller holds server.Lock.
+func (server *ServerRecord) lost(flow string) {
+	if r := server.flowResponder[flow]; r != nil {
+		r.lost()
+	}
+	server.LostCnt++
+	server.updateLoss()
+}
+
+// updateLoss computes Loss over the probes that were answered or timed out,
+// leaving out the ones still in flight; the caller holds server.Lock.
+func (server *ServerRecord) updateLoss() {
+	if done := server.RecvCnt + server.LostCnt; done > 0 {
+		server.Loss = 100 - float64(server.RecvCnt*100)/float64(done)
+	}
+}
+
+// responder returns the record of addr, adding it on its first reply; the
+// caller holds server.Lock.
+func (server *ServerRecord) responder(addr string) *ResponderRecord {
+	for _, r := range server.Responders {
+		if r.Addr == addr {
+			return r
+		}
+	}
+	r := newResponderRecord(addr)
+	server.Responders = append(server.Responders, r)
+	return r
+}
+
+// hasResponder reports whether addr answered at this TTL; the caller holds
+// server.Lock.
+func (server *ServerRecord) hasResponder(addr string) bool {
+	for _, r := range server.Responders {
+		if r.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// primary returns the responder with the most replies, the first to answer
+// on a tie; the caller holds server.Lock.
+func (server *ServerRecord) primary() *ResponderRecord {
+	var best *ResponderRecord
+	for _, r := range server.Responders {
+		if best == nil || r.RecvCnt > best.RecvCnt {
+			best = r
+		}
+	}
+	return best
 }
 
 func (t *TraceRoute) RecordSend(v *SendMetric) {
@@ -39,6 +182,20 @@ func (t *TraceRoute) RecordSend(v *SendMetric) {
 	}
 	db := tdb.(*StatsDB)
 	db.Cache.Store(v.ID, v, v.TimeStamp)
+	atomic.StoreInt64(&t.lastSend, v.TimeStamp.UnixNano())
+	atomic.AddInt64(&t.probesDone, 1)
+	if server := t.server(v.TTL); server != nil {
+		server.Lock.Lock()
+		server.SendCnt++
+		server.Lock.Unlock()
+	}
+	t.emit(Event{
+		Type:    ProbeSent,
+		Time:    v.TimeStamp,
+		FlowKey: v.FlowKey,
+		ID:      v.ID,
+		TTL:     int(v.TTL),
+	})
 }
 
 func (t *TraceRoute) RecordRecv(v *RecvMetric) bool {
@@ -48,51 +205,132 @@ func (t *TraceRoute) RecordRecv(v *RecvMetric) bool {
 	}
 
 	db := tdb.(*StatsDB)
-	tsendInfo, valid := db.Cache.Load(v.ID)
+	tsendInfo, valid := db.Cache.LoadAndDelete(v.ID)
 	if !valid {
 		return false
 	}
 	sendInfo := tsendInfo.(*SendMetric)
-	server := t.Metric[sendInfo.TTL]
-	server.Lock.Lock()
-	server.Addr = v.RespAddr
-	server.RecvCnt++
-	server.Success = true
-	server.SuccSum = int64(math.Min(float64(server.SuccSum+1), 10))
-	server.Loss = 100 - float64(server.SuccSum*100)/float64(t.Count)
+	server := t.server(sendInfo.TTL)
+	if server == nil {
+		return false
+	}
+	// 超时之后才到的回复算丢包，缓存只是定期清理，可能还没来得及删掉
+	if t.Timeout > 0 && v.TimeStamp.Sub(sendInfo.TimeStamp) > t.Timeout {
+		t.probeExpired(v.ID, sendInfo)
+		return false
+	}
+	if t.PMTU && t.tooBig(v) {
+		t.recordTooBig(v, sendInfo)
+		return true
+	}
 	latency := v.TimeStamp.Sub(sendInfo.TimeStamp)
-	server.LastTime = latency
-	if server.WrstTime == time.Duration(0) || latency > server.WrstTime {
-		server.WrstTime = latency
+	server.Lock.Lock()
+	server.recv(v.FlowKey, v.RespAddr, latency)
+	if len(v.MPLS) > 0 {
+		server.responder(v.RespAddr).MPLS = v.MPLS
 	}
-	if server.BestTime == time.Duration(0) || latency < server.BestTime {
-		server.BestTime = latency
+	if len(v.InterfaceInfo) > 0 {
+		server.responder(v.RespAddr).InterfaceInfo = v.InterfaceInfo
 	}
-	server.AllTime += latency
-	server.AvgTime = time.Duration((int64)(server.AllTime/time.Microsecond)/(server.SuccSum)) * time.Microsecond
+	if v.ReplyTTL > 0 {
+		server.responder(v.RespAddr).ReplyTTL = v.ReplyTTL
+	}
+	if v.QuotedTOS != nil {
+		server.responder(v.RespAddr).QuotedTOS = v.QuotedTOS
+	}
+	unreach := t.unreachable(v.RespAddr, v.ICMPType, v.ICMPCode)
+	if unreach != nil {
+		server.responder(v.RespAddr).Unreachable = unreach
+	}
+	t.addSample(server, ProbeSample{
+		ID:            v.ID,
+		Flow:          v.FlowKey,
+		Cycle:         sendInfo.Cycle,
+		SentAt:        sendInfo.TimeStamp,
+		Received:      true,
+		Responder:     v.RespAddr,
+		RTTMs:         durationMs(latency),
+		ICMPType:      v.ICMPType,
+		ICMPCode:      v.ICMPCode,
+		MPLS:          v.MPLS,
+		InterfaceInfo: v.InterfaceInfo,
+		ReplyTTL:      v.ReplyTTL,
+		QuotedTOS:     v.QuotedTOS,
+	})
+	hop := t.hopInfo(int(sendInfo.TTL), server)
 	server.Lock.Unlock()
-	return false
+
+	e := Event{
+		Type:          ReplyReceived,
+		Time:          v.TimeStamp,
+		FlowKey:       v.FlowKey,
+		ID:            v.ID,
+		TTL:           int(sendInfo.TTL),
+		Responder:     v.RespAddr,
+		RTT:           latency,
+		ICMPType:      v.ICMPType,
+		ICMPCode:      v.ICMPCode,
+		MPLS:          v.MPLS,
+		InterfaceInfo: v.InterfaceInfo,
+		ReplyTTL:      v.ReplyTTL,
+		QuotedTOS:     v.QuotedTOS,
+	}
+	t.emit(e)
+	reached := v.RespAddr == t.NetDstAddr.String()
+	if reached || unreach != nil {
+		// 持续模式不会提前结束，也不能每轮都加一条
+		if !t.Continuous {
+			if _, loaded := t.stoppedFlows.LoadOrStore(fmt.Sprint(v.FlowKey, "/", sendInfo.Cycle), true); !loaded {
+				atomic.AddInt64(&t.stoppedCnt, 1)
+			}
+		}
+		t.stopFlow(v.FlowKey, sendInfo.Cycle, int(sendInfo.TTL))
+	}
+	if reached {
+		t.destinationReached(e)
+	}
+	e.Type = HopUpdated
+	e.Hop = hop
+	t.emit(e)
+	return true
 }
 
 func (t *TraceRoute) IsFinish() bool {
+	if t.stopped() {
+		t.finish()
+		return true
+	}
 	// 全局超时
-	if time.Now().After(t.GlobalTimeout) {
+	if !t.GlobalTimeout.IsZero() && time.Now().After(t.GlobalTimeout) {
 		//fmt.Println("IsFinish, 超时了")
 		t.LastHop = -999
 		return true
 	}
-	key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, 1)
-	tdb, ok := t.DB.Load(key)
-	if !ok {
+	// 持续模式只在停止时结束
+	if t.Continuous {
+		return false
+	}
+	// MDA和PMTU发完时所有探测都已收到回复或超时
+	if t.MDA || t.PMTU {
+		if atomic.LoadInt32(&t.senderDone) == 1 {
+			t.finish()
+			return true
+		}
 		return false
 	}
-	db := tdb.(*StatsDB)
 	cur := time.Now()
-	// 先判断是不是包全发完了
-	if atomic.LoadUint64(db.SendCnt) == uint64(t.MaxTTL*t.Count) {
-		if cur.Sub(t.StartTime).Seconds()-float64(t.Count)*(t.Interval).Seconds() > t.Timeout.Seconds() {
+	// 先判断是不是包全发完了，跳过的TTL也算
+	if atomic.LoadInt64(&t.probesDone) >= int64((t.MaxTTL-t.firstTTL()+1)*t.Count*len(t.probePorts())) {
+		// 路径已经完整，剩下的包不会再改变结果
+		if t.pathComplete(cur) {
+			t.finish()
+			return true
+		}
+		// 限速时最后一个包可能发得很晚，也要等它超时
+		lastSend := time.Unix(0, atomic.LoadInt64(&t.lastSend))
+		if cur.Sub(t.StartTime).Seconds()-float64(t.Count)*(t.Interval).Seconds() > t.Timeout.Seconds() && cur.Sub(lastSend) > t.Timeout {
 			//fmt.Println("完成了完成了")
-			t.EndTime = time.Now()
+			t.finish()
 			// 如果所有包发完之后，过了超时时间，那也认为是完成
 			return true
 		}
@@ -100,6 +338,181 @@ func (t *TraceRoute) IsFinish() bool {
 	return false
 }
 
+// finish records EndTime the first time the trace is found finished; every
+// listener checks IsFinish.
+func (t *TraceRoute) finish() {
+	t.endMu.Lock()
+	if t.EndTime.IsZero() {
+		t.EndTime = time.Now()
+	}
+	t.endMu.Unlock()
+}
+
+// endTime returns EndTime, zero while the trace runs.
+func (t *TraceRoute) endTime() time.Time {
+	t.endMu.Lock()
+	defer t.endMu.Unlock()
+	return t.EndTime
+}
+
+// pathComplete reports whether the probes still in flight cannot change the
+// path: every flow reached the destination or was answered with an
+// Unreachable, or GapLimit TTLs in a row past the last hop that answered
+// stayed silent, and every lower TTL settled.
+func (t *TraceRoute) pathComplete(now time.Time) bool {
+	if atomic.LoadInt64(&t.stoppedCnt) >= int64(t.Count*len(t.probePorts())) {
+		return !t.inFlightBelow(t.maxFlowStop(), now)
+	}
+	if gap := t.gapEnd(now); gap > 0 {
+		return !t.inFlightBelow(gap+1, now)
+	}
+	return false
+}
+
+// flowStop is the lowest TTL at which a flow reached the destination or was
+// answered with an Unreachable, in the latest cycle that stopped it when
+// Continuous.
+type flowStop struct {
+	ttl, cycle int
+}
+
+// stopFlow records that the probe of flow key sent with ttl in cycle reached
+// the destination or got an Unreachable. ECMP flows may take paths of
+// different lengths or meet different filters, so each flow stops at its
+// own TTL.
+func (t *TraceRoute) stopFlow(key string, cycle, ttl int) {
+	t.stopMu.Lock()
+	defer t.stopMu.Unlock()
+	if t.flowStops == nil {
+		t.flowStops = make(map[string]flowStop)
+	}
+	s, ok := t.flowStops[key]
+	switch {
+	case !ok || t.Continuous && cycle > s.cycle:
+		t.flowStops[key] = flowStop{ttl: ttl, cycle: cycle}
+	case ttl < s.ttl && (!t.Continuous || cycle == s.cycle):
+		s.ttl = ttl
+		t.flowStops[key] = s
+	}
+}
+
+// flowLimit returns the TTL flow key stops at in cycle, or 0.
+func (t *TraceRoute) flowLimit(key string, cycle int) int {
+	t.stopMu.Lock()
+	defer t.stopMu.Unlock()
+	s, ok := t.flowStops[key]
+	// 持续模式只沿用上一轮的终点，路径变长时再下一轮就会探测更远
+	if !ok || t.Continuous && s.cycle < cycle-1 {
+		return 0
+	}
+	return s.ttl
+}
+
+// maxFlowStop returns the highest TTL any flow stops at.
+func (t *TraceRoute) maxFlowStop() int {
+	t.stopMu.Lock()
+	defer t.stopMu.Unlock()
+	max := 0
+	for _, s := range t.flowStops {
+		if s.ttl > max {
+			max = s.ttl
+		}
+	}
+	return max
+}
+
+// ttlLimit returns the highest TTL still worth probing for flow key in
+// cycle: the TTL the flow reached the destination or got an Unreachable at,
+// or the last of a silent gap of GapLimit TTLs, MaxTTL otherwise.
+func (t *TraceRoute) ttlLimit(key string, cycle int) int {
+	if stop := t.flowLimit(key, cycle); stop > 0 {
+		return stop
+	}
+	if gap := t.gapEnd(time.Now()); gap > 0 {
+		return gap
+	}
+	return t.MaxTTL
+}
+
+// skip accounts for a probe of flow key in cycle that a sender left out
+// because its TTL is past ttlLimit, and reports whether ttl should be
+// skipped.
+func (t *TraceRoute) skip(key string, cycle, ttl int) bool {
+	if ttl <= t.ttlLimit(key, cycle) {
+		return false
+	}
+	atomic.AddInt64(&t.probesDone, 1)
+	return true
+}
+
+// gapEnd returns the last TTL of GapLimit silent TTLs in a row past the last
+// hop that answered, once a probe to each of them timed out, or 0.
+func (t *TraceRoute) gapEnd(now time.Time) int {
+	if t.GapLimit <= 0 {
+		return 0
+	}
+	top := t.firstTTL() - 1
+	for ttl := t.MaxTTL; ttl >= t.firstTTL(); ttl-- {
+		server := t.server(uint8(ttl))
+		if server == nil {
+			continue
+		}
+		server.Lock.Lock()
+		answered := server.RecvCnt > 0
+		server.Lock.Unlock()
+		if answered {
+			top = ttl
+			break
+		}
+	}
+	end := top + t.GapLimit
+	if end >= t.MaxTTL {
+		return 0
+	}
+
+	// 超时还没被清理的包也算超时
+	timedOut := make(map[int]bool)
+	t.DB.Range(func(_, tdb interface{}) bool {
+		tdb.(*StatsDB).Cache.Data.Range(func(_, v interface{}) bool {
+			if m, ok := v.(*SendMetric); ok && now.Sub(m.TimeStamp) > t.Timeout {
+				timedOut[int(m.TTL)] = true
+			}
+			return true
+		})
+		return true
+	})
+	for ttl := top + 1; ttl <= end; ttl++ {
+		server := t.server(uint8(ttl))
+		if server == nil {
+			return 0
+		}
+		server.Lock.Lock()
+		lost := server.LostCnt > 0
+		server.Lock.Unlock()
+		if !lost && !timedOut[ttl] {
+			return 0
+		}
+	}
+	return end
+}
+
+// inFlightBelow reports whether a probe with a TTL below ttl was sent less
+// than Timeout ago and is still waiting for its reply.
+func (t *TraceRoute) inFlightBelow(ttl int, now time.Time) bool {
+	found := false
+	t.DB.Range(func(_, tdb interface{}) bool {
+		tdb.(*StatsDB).Cache.Data.Range(func(_, v interface{}) bool {
+			m, ok := v.(*SendMetric)
+			if ok && int(m.TTL) < ttl && now.Sub(m.TimeStamp) <= t.Timeout {
+				found = true
+			}
+			return !found
+		})
+		return !found
+	})
+	return found
+}
+
 type HopData struct {
 	Hop     int
 	Details []map[string]interface{}
@@ -116,19 +529,75 @@ type HopInfo struct {
 	Wrst  float64
 }
 
+// server returns the record of ttl, or nil when ttl is out of range.
+func (t *TraceRoute) server(ttl uint8) *ServerRecord {
+	if ttl == 0 || int(ttl) >= len(t.Metric) {
+		return nil
+	}
+	return t.Metric[ttl]
+}
+
+// hopInfo summarizes server, the caller holds server.Lock.
+func (t *TraceRoute) hopInfo(index int, server *ServerRecord) HopInfo {
+	server = t.view(server)
+	if !server.Success {
+		return HopInfo{Index: index, Host: "???", Loss: 100, Snt: int(server.SendCnt)}
+	}
+	return HopInfo{
+		Index: index,
+		Host:  server.Addr,
+		Loss:  FloatTrunc(server.Loss, 1),
+		Snt:   int(server.SendCnt),
+		Last:  Time2Float(server.LastTime),
+		Avg:   Time2Float(server.AvgTime),
+		Best:  Time2Float(server.BestTime),
+		Wrst:  Time2Float(server.WrstTime),
+	}
+}
+
+// Statistics formats what has been recorded so far into HopStr, HopDetail
+// and LastHop. It leaves the probes in flight alone, so it may be called at
+// any time during the run.
 func (t *TraceRoute) Statistics() {
+	text, hops, lastHop := t.report()
+	t.LastHop = lastHop
+	if lastHop == 0 {
+		t.HopStr = ""
+		return
+	}
+	t.HopStr = text
+	t.HopDetail = hops
+	if t.Af == "ip6" {
+		t.Hops = t.hopData()
+	}
+}
+
+// Report returns the table Statistics puts in HopStr for what the trace has
+// recorded so far, without counting the probes still in flight as lost. In
+// a continuous trace it shows the stats window, like a live mtr display.
+func (t *TraceRoute) Report() string {
+	text, _, _ := t.report()
+	return text
+}
+
+func (t *TraceRoute) report() (string, []HopInfo, int) {
 	var buffer bytes.Buffer
 	buffer.WriteString(fmt.Sprintf("Start: %v, DestAddr: %v\n", t.StartTime.Format("2006-01-02 15:04:05"), t.Dest))
 	buffer.WriteString(fmt.Sprintf("%-3v %-40v  %10v%c  %10v  %10v  %10v  %10v  %10v\n", "", "HOST", "Loss", '%', "Snt", "Last", "Avg", "Best", "Wrst"))
 
 	hops := make([]HopInfo, 0)
 	lastHop := 0
+	dst := t.NetDstAddr.String()
 	for index, item := range t.Metric {
 		if index == 0 {
 			continue
 		}
-		if item.Success {
-			if item.Addr == t.NetDstAddr.String() {
+		item.Lock.Lock()
+		v := t.view(item)
+		success, reached, end := v.Success, v.hasResponder(dst), t.endsPath(index, v)
+		item.Lock.Unlock()
+		if success {
+			if reached || end {
 				lastHop = index
 				break
 			} else {
@@ -136,46 +605,83 @@ func (t *TraceRoute) Statistics() {
 			}
 		}
 	}
-	t.LastHop = lastHop
 	if lastHop == 0 {
-		t.HopStr = ""
-		return
+		return "", hops, 0
 	}
-	//if t.LastHop > t.MaxTTL {
-	//	t.LastHop = t.MaxTTL
-	//}
-	for index, item := range t.Metric[0 : t.LastHop+1] {
-		if index == 0 {
+	// 最后一跳之后的那一跳可能超出了MaxTTL
+	if lastHop >= len(t.Metric) {
+		lastHop = len(t.Metric) - 1
+	}
+	if lastHop > t.MaxTTL {
+		lastHop = t.MaxTTL
+	}
+	var quoted []ResultHop
+	for index, item := range t.Metric[0 : lastHop+1] {
+		if index < t.firstTTL() {
 			continue
 		}
-		if item.Success {
-			hops = append(hops, HopInfo{
-				Index: index,
-				Host:  item.Addr,
-				Loss:  FloatTrunc(item.Loss, 1),
-				Snt:   t.Count,
-				Last:  Time2Float(item.LastTime),
-				Avg:   Time2Float(item.AvgTime),
-				Best:  Time2Float(item.BestTime),
-				Wrst:  Time2Float(item.WrstTime),
-			})
-			buffer.WriteString(fmt.Sprintf("%-3d %-40v  %10.1f%c  %10v  %10.2f  %10.2f  %10.2f  %10.2f\n", item.TTL, item.Addr, item.Loss, '%', t.Count, Time2Float(item.LastTime), Time2Float(item.AvgTime), Time2Float(item.BestTime), Time2Float(item.WrstTime)))
+		item.Lock.Lock()
+		hops = append(hops, t.hopInfo(index, item))
+		if v := t.view(item); v.Success {
+			quoted = append(quoted, ResultHop{TTL: index, Addr: v.primary().Addr, QuotedTOS: v.primary().QuotedTOS})
+			// 每个回复的地址一行，和mtr一样只在第一行显示TTL
+			for i, r := range v.Responders {
+				ttl := ""
+				if i == 0 {
+					ttl = fmt.Sprint(item.TTL)
+				}
+				line := fmt.Sprintf("%-3v %-40v  %10.1f%c  %10v  %10.2f  %10.2f  %10.2f  %10.2f", ttl, r.Addr, r.Loss, '%', r.SendCnt, Time2Float(r.LastTime), Time2Float(r.AvgTime), Time2Float(r.BestTime), Time2Float(r.WrstTime))
+				// 和traceroute一样在行尾标出!H、!N、!X等
+				if r.Unreachable != nil && r.Unreachable.Marker != "" {
+					line += "  " + r.Unreachable.Marker
+				}
+				buffer.WriteString(line + "\n")
+				if len(r.MPLS) > 0 {
+					buffer.WriteString(fmt.Sprintf("%-3v %v\n", "", formatMPLS(r.MPLS)))
+				}
+				for _, info := range r.InterfaceInfo {
+					buffer.WriteString(fmt.Sprintf("%-3v %v\n", "", info))
+				}
+				if p := replyPath(int(item.TTL), r); p.Asymmetric {
+					buffer.WriteString(fmt.Sprintf("%-3v <ASYM:return %v hops,forward %v>\n", "", p.ReturnHops, item.TTL))
+				}
+			}
 		} else {
-			hops = append(hops, HopInfo{
-				Index: index,
-				Host:  "???",
-				Loss:  100,
-				Snt:   t.Count,
-				Last:  0,
-				Avg:   0,
-				Best:  0,
-				Wrst:  0,
-			})
 			buffer.WriteString(fmt.Sprintf("%-3d %-40v  %10.1f%c  %10v  %10.2f  %10.2f  %10.2f  %10.2f\n", item.TTL, "???", float32(100), '%', int(0), float32(0), float32(0), float32(0), float32(0)))
 		}
+		item.Lock.Unlock()
 	}
-	t.HopStr = buffer.String()
-	t.HopDetail = hops
+	if t.TCPMultiPort {
+		for _, p := range t.TCPPortResults() {
+			state := p.State
+			if state == TCPPortUnknown {
+				state = "no answer"
+			}
+			stop := "no reply"
+			if p.LastTTL > 0 {
+				stop = fmt.Sprintf("%v (%v)", p.LastTTL, p.LastHop)
+			}
+			buffer.WriteString(fmt.Sprintf("Port %-5v %-10v last hop: %v\n", p.Port, state, stop))
+		}
+	}
+	if t.PMTU {
+		mtu, drops := t.PathMTU()
+		for _, d := range drops {
+			switch {
+			case d.BlackHole:
+				buffer.WriteString(fmt.Sprintf("MTU %-5v before hop %v: black hole, larger packets vanish without an ICMP error\n", d.MTU, d.TTL))
+			case d.TTL == 0:
+				buffer.WriteString(fmt.Sprintf("MTU %-5v on the local link\n", d.MTU))
+			default:
+				buffer.WriteString(fmt.Sprintf("MTU %-5v before hop %v: reported by %v\n", d.MTU, d.TTL, d.Addr))
+			}
+		}
+		buffer.WriteString(fmt.Sprintf("Path MTU: %v\n", mtu))
+	}
+	for _, c := range tosChanges(t.TOS, quoted) {
+		buffer.WriteString(c.String() + "\n")
+	}
+	return buffer.String(), hops, lastHop
 }
 
 // Time2Float 时间转float，保留1位小数
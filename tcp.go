@@ -2,105 +2,259 @@ package ztrace
 
 import (
 	"encoding/binary"
-	"math/rand"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/ipv4"
 )
 
 func (t *TraceRoute) SendIPv4TCP() error {
-	dport := t.TCPDPort
-	sport := uint16(1000 + t.PortOffset + rand.Int31n(500))
-
-	key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), sport, dport, 6)
-	db := NewStatsDB(key)
-
-	t.DB.Store(key, db)
-	go db.Cache.Run()
-	conn, err := net.ListenPacket("ip4:tcp", t.NetSrcAddr.String())
-	if err != nil {
-		logrus.Error(err)
-		return err
-	}
-	defer conn.Close()
+	return t.sendIPv4TCP(t.TCPDPort)
+}
 
-	rSocket, err := ipv4.NewRawConn(conn)
+func (t *TraceRoute) sendIPv4TCP(dport uint16) error {
+	sport, key, db := t.newPortFlow(6, dport)
+	t.flowPorts.Store(key, dport)
+	rSocket, err := t.transport().ListenRaw("ip4:tcp", t.NetSrcAddr.String())
 	if err != nil {
 		logrus.Error("can not create raw socket:", err)
 		return err
 	}
 	defer rSocket.Close()
+	t.closeOnDone(rSocket)
 
 	seq := uint32(1000)
 	mod := uint32(1 << 30)
 
-	for ttl := 1; ttl <= int(t.MaxTTL); ttl++ {
-		hdr, payload := t.BuildIPv4TCPSYN(sport, dport, uint8(ttl), seq, 0)
-		rSocket.WriteTo(hdr, payload, nil)
-
-		m := &SendMetric{
-			FlowKey:   key,
-			ID:        seq,
-			TTL:       uint8(ttl),
-			TimeStamp: time.Now(),
+	for cycle := 0; t.moreCycles(cycle, 1); cycle++ {
+		if cycle > 0 && !t.sleep(t.Interval) {
+			return nil
 		}
-		seq = (seq + 4) % mod
+		t.startCycle(cycle)
+		for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+			if t.skip(key, cycle, ttl) {
+				continue
+			}
+			if !t.pace() {
+				return nil
+			}
+			hdr, payload := t.BuildIPv4TCPSYN(sport, dport, uint8(ttl), seq, t.TOS)
+			m := &SendMetric{
+				FlowKey:   key,
+				ID:        seq,
+				TTL:       uint8(ttl),
+				TimeStamp: time.Now(),
+				Cycle:     cycle,
+			}
+			seq = (seq + 4) % mod
 
-		t.RecordSend(m)
+			// 先记下再发，回复可能比RecordSend先到
+			atomic.AddUint64(db.SendCnt, 1)
+			t.RecordSend(m)
+			rSocket.WriteTo(hdr, payload, nil)
+		}
 	}
-	t.StartTime = time.Now()
 
 	return nil
 }
 
+// ListenIPv4TCP_ICMP receives the ICMP replies to TCP probes.
+//
+// Deprecated: ListenIPv4ICMP handles the replies of every protocol.
 func (t *TraceRoute) ListenIPv4TCP_ICMP() error {
-	laddr := &net.IPAddr{IP: t.NetSrcAddr}
-	var err error
+	return t.ListenIPv4ICMP()
+}
+
+// TCPPortState is what the destination answered to the SYN probes of a port.
+type TCPPortState string
+
+const (
+	TCPPortUnknown TCPPortState = ""       // no SYN-ACK or RST was received
+	TCPPortOpen    TCPPortState = "open"   // answered with SYN-ACK
+	TCPPortClosed  TCPPortState = "closed" // answered with RST
+)
 
-	t.recvICMPConn, err = net.ListenIP("ip4:icmp", laddr)
+// TCPPortState returns what the destination answered on port.
+func (t *TraceRoute) TCPPortState(port uint16) TCPPortState {
+	if v, ok := t.tcpPorts.Load(port); ok {
+		return v.(TCPPortState)
+	}
+	return TCPPortUnknown
+}
+
+// tcpState returns the port state told by the flags of a segment from the
+// destination, and false when it is neither SYN-ACK nor RST.
+func tcpState(flags byte) (TCPPortState, bool) {
+	switch {
+	case flags&TCP_RST != 0:
+		return TCPPortClosed, true
+	case flags&(TCP_SYN|TCP_ACK) == TCP_SYN|TCP_ACK:
+		return TCPPortOpen, true
+	}
+	return TCPPortUnknown, false
+}
+
+// recordTCPPort records the state of port told by an answer to a probe.
+func (t *TraceRoute) recordTCPPort(port uint16, state TCPPortState) {
+	if state == TCPPortOpen {
+		t.tcpPorts.Store(port, state)
+		return
+	}
+	// 端口打开的回复优先，丢掉打开之后再收到的RST
+	t.tcpPorts.LoadOrStore(port, state)
+}
+
+// tcpFlow reports whether key is one of the TCP flows of the trace, so that
+// segments of other connections to the destination are left alone.
+func (t *TraceRoute) tcpFlow(key string) bool {
+	_, ok := t.flowPorts.Load(key)
+	return ok
+}
+
+// ListenIPv4TCP matches the SYN-ACK or RST of the destination to the SYN it
+// acknowledges, and resets the half-open connections of SYN-ACKs. Reads
+// from an ip4:tcp socket return the segment without the IP header.
+func (t *TraceRoute) ListenIPv4TCP() error {
+	conn, rSocket, err := t.listenIPv4TCP()
 	if err != nil {
-		logrus.Error("bind failure:", err)
 		return err
 	}
-	defer t.recvICMPConn.Close()
+	return t.recvIPv4TCP(conn, rSocket)
+}
+
+// listenIPv4TCP opens the sockets of ListenIPv4TCP: conn to read the answers
+// of the destination and rSocket to reset them.
+func (t *TraceRoute) listenIPv4TCP() (conn PacketConn, rSocket RawConn, err error) {
+	conn, err = t.transport().ListenPacket("ip4:tcp", t.NetSrcAddr.String())
+	if err != nil {
+		logrus.Error("bind failure:", err)
+		return nil, nil, err
+	}
+	rSocket, err = t.transport().ListenRaw("ip4:tcp", t.NetSrcAddr.String())
+	if err != nil {
+		logrus.Error("can not create raw socket:", err)
+		conn.Close()
+		return nil, nil, err
+	}
+	t.closeOnDone(conn)
+	return conn, rSocket, nil
+}
 
-	t.recvICMPConn.SetReadDeadline(time.Now().Add(t.Timeout))
+// recvIPv4TCP is the receive loop of ListenIPv4TCP; it closes both sockets.
+func (t *TraceRoute) recvIPv4TCP(conn PacketConn, rSocket RawConn) error {
+	defer conn.Close()
+	defer rSocket.Close()
 
+	buf := make([]byte, 1500)
 	for {
-		buf := make([]byte, 1500)
-
-		n, raddr, err := t.recvICMPConn.ReadFrom(buf)
+		if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200)); err != nil {
+			return err
+		}
+		n, cm, src, err := conn.ReadFrom(buf)
 		if err != nil {
-			break
+			if t.stopped() {
+				break
+			}
+			if neterr, ok := err.(*net.OpError); ok && neterr.Timeout() {
+				if t.IsFinish() {
+					break
+				}
+				continue
+			}
+			return err
+		}
+
+		if n < 20 || addrIP(src) != t.NetDstAddr.String() {
+			continue
+		}
+		srcPort := binary.BigEndian.Uint16(buf[0:2])
+		dstPort := binary.BigEndian.Uint16(buf[2:4])
+		ack := binary.BigEndian.Uint32(buf[8:12])
+		flags := buf[13]
+		state, ok := tcpState(flags)
+		key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), dstPort, srcPort, 6)
+		if !ok || !t.tcpFlow(key) {
+			continue
+		}
+		// 只处理回复我们探测的报文，别的连接不能被重置
+		if !t.RecordRecv(&RecvMetric{
+			FlowKey:   key,
+			ID:        ack - 1,
+			RespAddr:  t.NetDstAddr.String(),
+			TimeStamp: time.Now(),
+			ReplyTTL:  replyTTL(cm),
+		}) {
+			continue
+		}
+		t.recordTCPPort(srcPort, state)
+		if state == TCPPortOpen {
+			hdr, payload := t.BuildIPv4TCPPRST(dstPort, srcPort, 64, ack, 0)
+			if err := rSocket.WriteTo(hdr, payload, nil); err != nil {
+				logrus.Error("send RST failed:", err)
+			}
 		}
+	}
+	return nil
+}
 
-		icmpType := buf[0]
+// maxTCPProbePorts bounds the ports of a multi-port trace, each of which
+// sends Count flows.
+const maxTCPProbePorts = 64
 
-		if (raddr.String() == t.NetDstAddr.String() || icmpType == 11 || (icmpType == 3 && buf[1] == 3)) && (n >= 36) {
-			seq := binary.BigEndian.Uint32(buf[32:36])
-			dstip := net.IP(buf[24:28])
-			srcip := net.IP(buf[20:24])
-			srcPort := binary.BigEndian.Uint16(buf[28:30])
-			dstPort := binary.BigEndian.Uint16(buf[30:32])
+// TCPPortRange returns the ports from first to last, for TCPProbePorts.
+func TCPPortRange(first, last uint16) []uint16 {
+	var ports []uint16
+	for p := int(first); p <= int(last); p++ {
+		ports = append(ports, uint16(p))
+	}
+	return ports
+}
 
-			if dstip.Equal(t.NetDstAddr) {
-				key := GetHash(srcip, dstip, srcPort, dstPort, 6)
+// probePorts returns the destination ports TCP probes are sent to.
+func (t *TraceRoute) probePorts() []uint16 {
+	if t.Protocol == "tcp" && t.TCPMultiPort {
+		return t.TCPProbePorts
+	}
+	return []uint16{t.TCPDPort}
+}
 
-				m := &RecvMetric{
-					FlowKey:   key,
-					ID:        seq,
-					RespAddr:  raddr.String(),
-					TimeStamp: time.Now(),
-				}
+// ResultTCPPort is the outcome of the probes to one port of a multi-port
+// trace. LastTTL and LastHop are the farthest hop that answered a probe to
+// the port: the destination when the port answered, the hop before the
+// filter dropping the port otherwise.
+type ResultTCPPort struct {
+	Port    uint16       `json:"port"`
+	State   TCPPortState `json:"state,omitempty"` // open, closed or empty when nothing answered
+	LastTTL int          `json:"last_ttl,omitempty"`
+	LastHop string       `json:"last_hop,omitempty"`
+}
 
-				t.RecordRecv(m)
+// TCPPortResults returns, for every probed port in order, what the
+// destination answered and where the path of the port stops.
+func (t *TraceRoute) TCPPortResults() []ResultTCPPort {
+	ports := t.probePorts()
+	index := make(map[uint16]int, len(ports))
+	results := make([]ResultTCPPort, len(ports))
+	for i, port := range ports {
+		index[port] = i
+		results[i] = ResultTCPPort{Port: port, State: t.TCPPortState(port)}
+	}
+	for ttl := 1; ttl < len(t.Metric) && ttl <= t.MaxTTL; ttl++ {
+		server := t.Metric[ttl]
+		server.Lock.Lock()
+		for _, s := range server.Samples {
+			v, ok := t.flowPorts.Load(s.Flow)
+			if !ok || !s.Received {
+				continue
+			}
+			r := &results[index[v.(uint16)]]
+			// 到达目的端之后的TTL也会收到目的端的回复，只记第一次
+			if r.LastTTL < ttl && r.LastHop != t.NetDstAddr.String() {
+				r.LastTTL, r.LastHop = ttl, s.Responder
 			}
 		}
+		server.Lock.Unlock()
 	}
-
-	t.Statistics()
-
-	return nil
+	return results
 }
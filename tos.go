@@ -0,0 +1,77 @@
+package ztrace
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ecnNames are the ECN codepoints of RFC 3168, by the value of the low two
+// bits of the TOS or traffic class.
+var ecnNames = [4]string{"Not-ECT", "ECT(1)", "ECT(0)", "CE"}
+
+// quotedTOS returns the TOS or traffic class of the IP packet quoted in an
+// ICMP error, or nil when b does not start with an IP header.
+func quotedTOS(b []byte) *int {
+	if len(b) < 2 {
+		return nil
+	}
+	var tos int
+	switch b[0] >> 4 {
+	case 4:
+		tos = int(b[1])
+	case 6:
+		tos = int(b[0]&0x0f)<<4 | int(b[1]>>4)
+	default:
+		return nil
+	}
+	return &tos
+}
+
+// ResultTOSChange is a hop whose ICMP errors quote the probes with the TOS or
+// traffic class To, while the hops before it quoted From, or From is what the
+// probes were sent with. A router in front of the hop re-marked the probes.
+type ResultTOSChange struct {
+	TTL  int    `json:"ttl"`
+	Addr string `json:"addr"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// String describes what happened to the DSCP and ECN bits.
+func (c ResultTOSChange) String() string {
+	var parts []string
+	if from, to := c.From>>2, c.To>>2; from != to {
+		if to == 0 {
+			parts = append(parts, fmt.Sprintf("DSCP %v -> 0 (bleached)", from))
+		} else {
+			parts = append(parts, fmt.Sprintf("DSCP %v -> %v (rewritten)", from, to))
+		}
+	}
+	if from, to := c.From&3, c.To&3; from != to {
+		s := fmt.Sprintf("ECN %v -> %v", ecnNames[from], ecnNames[to])
+		// ECT(0)和ECT(1)被清掉后，拥塞就无法再被标记
+		if to == 0 {
+			s += " (ECT cleared)"
+		}
+		parts = append(parts, s)
+	}
+	return fmt.Sprintf("TOS 0x%02x -> 0x%02x at hop %v (%v): %v", c.From, c.To, c.TTL, c.Addr, strings.Join(parts, ", "))
+}
+
+// tosChanges walks the hops and returns those where the TOS quoted by the
+// first responder differs from the one quoted before, starting from the TOS
+// the probes were sent with. Hops that quoted nothing are skipped.
+func tosChanges(sent int, hops []ResultHop) []ResultTOSChange {
+	var changes []ResultTOSChange
+	prev := sent
+	for _, hop := range hops {
+		if hop.QuotedTOS == nil {
+			continue
+		}
+		if *hop.QuotedTOS != prev {
+			changes = append(changes, ResultTOSChange{TTL: hop.TTL, Addr: hop.Addr, From: prev, To: *hop.QuotedTOS})
+			prev = *hop.QuotedTOS
+		}
+	}
+	return changes
+}
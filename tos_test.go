@@ -0,0 +1,60 @@
+package ztrace
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuotedTOS(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want int // -1 if nil
+	}{
+		{[]byte{0x45, 0xb8}, 0xb8},
+		{[]byte{0x45, 0x00}, 0},
+		{[]byte{0x6b, 0x80}, 0xb8},
+		{[]byte{0x60, 0x10}, 0x01},
+		{[]byte{0x45}, -1},
+		{[]byte{0x00, 0xb8}, -1},
+	}
+	for _, tt := range tests {
+		got := quotedTOS(tt.b)
+		if tt.want < 0 {
+			if got != nil {
+				t.Errorf("quotedTOS(% x) = %v, want nil", tt.b, *got)
+			}
+			continue
+		}
+		if got == nil || *got != tt.want {
+			t.Errorf("quotedTOS(% x) = %v, want %#x", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestTOSChanges(t *testing.T) {
+	tos := func(v int) *int { return &v }
+	hops := []ResultHop{
+		{TTL: 1, Addr: "10.0.0.1", QuotedTOS: tos(0xb8)},
+		{TTL: 2, Addr: "10.0.1.1"},
+		{TTL: 3, Addr: "10.0.2.1", QuotedTOS: tos(0x00)},
+		{TTL: 4, Addr: "10.0.3.1", QuotedTOS: tos(0x00)},
+		{TTL: 5, Addr: "10.0.4.1", QuotedTOS: tos(0x03)},
+	}
+	want := []ResultTOSChange{
+		{TTL: 3, Addr: "10.0.2.1", From: 0xb8, To: 0x00},
+		{TTL: 5, Addr: "10.0.4.1", From: 0x00, To: 0x03},
+	}
+	got := tosChanges(0xb8, hops)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tosChanges = %+v, want %+v", got, want)
+	}
+	if s := got[0].String(); s != "TOS 0xb8 -> 0x00 at hop 3 (10.0.2.1): DSCP 46 -> 0 (bleached)" {
+		t.Errorf("String() = %q", s)
+	}
+	if s := (ResultTOSChange{TTL: 2, Addr: "10.0.1.1", From: 0x02, To: 0x00}).String(); s != "TOS 0x02 -> 0x00 at hop 2 (10.0.1.1): ECN ECT(0) -> Not-ECT (ECT cleared)" {
+		t.Errorf("String() = %q", s)
+	}
+	if got := tosChanges(0, hops[1:2]); got != nil {
+		t.Errorf("tosChanges without quotes = %+v, want none", got)
+	}
+}
@@ -1,7 +1,10 @@
 package ztrace
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"runtime"
 	"sync"
@@ -23,6 +26,8 @@ type SendMetric struct {
 	ID        uint32
 	TTL       uint8
 	TimeStamp time.Time
+	Cycle     int // round of probes the probe belongs to, from 0
+	Size      int // packet size of PMTU probes
 }
 
 type RecvMetric struct {
@@ -30,6 +35,14 @@ type RecvMetric struct {
 	ID        uint32
 	RespAddr  string
 	TimeStamp time.Time
+	ReplyTTL  int // TTL or hop limit the reply arrived with, 0 when unknown
+	ICMPType  int
+	ICMPCode  int
+	MTU       int         // next-hop MTU of a Fragmentation Needed or Packet Too Big
+	QuotedTOS *int        // TOS or traffic class of the probe quoted in an ICMP error
+	MPLS      []MPLSLabel // label stack quoted in the ICMP extensions
+	// InterfaceInfo are the RFC 5837 objects quoted in the ICMP extensions.
+	InterfaceInfo []InterfaceInfo
 }
 
 type TraceRoute struct {
@@ -38,15 +51,49 @@ type TraceRoute struct {
 	Dest          string
 	TCPDPort      uint16
 	TCPProbePorts []uint16
+	TCPMultiPort  bool
 	Count         int
 	Interval      time.Duration
+	FirstTTL      int // first TTL probed, hops before it are not shown
 	MaxTTL        int
 	Protocol      string
-	PacketRate    float32
+	PacketRate    float32 // probes per second, 0 is unlimited
 	WideMode      bool
 	PortOffset    int32
 	LastHop       int
 
+	// Paris keeps every field per-flow load balancers hash constant across
+	// the TTLs of a flow, as Paris traceroute does. UDP probes carry their ID
+	// in the UDP checksum by tweaking the payload, ICMP probes keep the echo
+	// checksum of a round constant by moving the echo ID against Seq. TCP
+	// probes only vary the sequence number and need no change.
+	Paris bool
+
+	MDA           bool
+	MDAConfidence float64
+
+	// GapLimit ends the trace once this many TTLs in a row past the last hop
+	// that answered stayed silent, 0 is no limit.
+	GapLimit int
+
+	// TOS is the TOS or traffic class byte of the probes: DSCP in the high
+	// six bits, ECN in the low two.
+	TOS int
+
+	// PMTU traces hop by hop with UDP probes that may not be fragmented,
+	// starting at MTU bytes and shrinking to the path MTU, see TracePMTU.
+	// Over IPv6, SystemTransport supports it on Linux only.
+	PMTU bool
+	MTU  int
+
+	// Continuous probes until the trace is stopped. The hop stats then
+	// cover the last WindowCycles rounds and the probes sent in the last
+	// WindowTime, and a Snapshot event is emitted every SnapshotInterval.
+	Continuous       bool
+	WindowCycles     int
+	WindowTime       time.Duration
+	SnapshotInterval time.Duration
+
 	NetSrcAddr net.IP
 	NetDstAddr net.IP
 
@@ -54,8 +101,28 @@ type TraceRoute struct {
 
 	stopSignal *int32
 
-	recvICMPConn *net.IPConn
-	recvTCPConn  *net.IPConn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	Transport Transport
+	Observer  Observer
+
+	destReached  int32
+	tcpPorts     sync.Map // port -> TCPPortState
+	flowPorts    sync.Map // flow key -> destination port of TCP flows
+	senderDone   int32    // set once the MDA or PMTU sender, which decides when to stop, returns
+	bucket       tokenBucket
+	lastSend     int64    // UnixNano of the last probe sent
+	cycle        int64    // latest round started by a sender
+	probesDone   int64    // probes sent or skipped past ttlLimit
+	stoppedFlows sync.Map // flow and round that reached the destination or an Unreachable, unused when Continuous
+	stoppedCnt   int64
+	stopMu       sync.Mutex
+	flowStops    map[string]flowStop // flow key -> TTL the flow stops at
+	endMu        sync.Mutex
+	pmtuMu       sync.Mutex
+	pathMTU      int             // largest probe size known to pass, PMTU mode
+	mtuDrops     []ResultMTUDrop // where pathMTU went down
 
 	DB         sync.Map
 	Metric     []*ServerRecord
@@ -81,16 +148,112 @@ type StatsDB struct {
 }
 
 func NewStatsDB(key string) *StatsDB {
-	cacheTimeout := 6 * time.Second
-	checkFreq := 1 * time.Second
+	return newStatsDB(key, 6*time.Second)
+}
+
+// newStatsDB returns the stats of the flow key, whose probes expire timeout
+// after they were sent. The cache is swept ten times per timeout, so that a
+// probe is reported lost soon after its timeout.
+func newStatsDB(key string, timeout time.Duration) *StatsDB {
+	checkFreq := timeout / 10
+	if checkFreq < 10*time.Millisecond {
+		checkFreq = 10 * time.Millisecond
+	} else if checkFreq > time.Second {
+		checkFreq = time.Second
+	}
 	var cnt uint64
 	px := &StatsDB{
-		Cache:   tsyncmap.NewMap(key, cacheTimeout, checkFreq, false),
+		Cache:   tsyncmap.NewMap(key, timeout, checkFreq, false),
 		SendCnt: &cnt,
 	}
 	return px
 }
 
+// flowStats returns the stats of the flow key, whose probes are reported
+// lost once Timeout passes without a reply.
+func (t *TraceRoute) flowStats(key string) *StatsDB {
+	var db *StatsDB
+	if t.Timeout > 0 {
+		db = newStatsDB(key, t.Timeout)
+	} else {
+		db = NewStatsDB(key)
+	}
+	db.Cache.OnExpire = t.probeExpired
+	return db
+}
+
+// newFlow registers the stats of the flow key and starts expiring its probes.
+func (t *TraceRoute) newFlow(key string) *StatsDB {
+	db := t.flowStats(key)
+	t.DB.Store(key, db)
+	go db.Cache.RunContext(t.context())
+	return db
+}
+
+// newPortFlow registers a UDP or TCP flow to dport from a random source port
+// that no other flow of the trace uses: flows on the same ports would share
+// a key, mix up their probes and never all be counted as stopped.
+func (t *TraceRoute) newPortFlow(proto uint16, dport uint16) (sport uint16, key string, db *StatsDB) {
+	src, dst := t.NetSrcAddr.To4(), t.NetDstAddr.To4()
+	if t.Af == "ip6" {
+		src, dst = t.NetSrcAddr.To16(), t.NetDstAddr.To16()
+	}
+	for {
+		sport = uint16(1000 + t.PortOffset + rand.Int31n(500))
+		key = GetHash(src, dst, sport, dport, proto)
+		db = t.flowStats(key)
+		if _, used := t.DB.LoadOrStore(key, db); !used {
+			go db.Cache.RunContext(t.context())
+			return sport, key, db
+		}
+	}
+}
+
+// maxTTL is the highest TTL an IP header can carry.
+const maxTTL = 255
+
+// sizeMetric makes room in Metric for every TTL up to MaxTTL, which may have
+// been raised since the trace was created.
+func (t *TraceRoute) sizeMetric() {
+	if len(t.Metric) == 0 {
+		t.Metric = []*ServerRecord{nil}
+	}
+	for ttl := len(t.Metric); ttl <= t.MaxTTL && ttl <= maxTTL; ttl++ {
+		t.Metric = append(t.Metric, &ServerRecord{
+			TTL:      uint8(ttl),
+			Addr:     "???",
+			Name:     "",
+			Session:  "",
+			RecvCnt:  0,
+			Lock:     &sync.Mutex{},
+			Loss:     100,
+			LastTime: time.Duration(0),
+			WrstTime: time.Duration(0),
+			BestTime: time.Duration(0),
+			AvgTime:  time.Duration(0),
+			AllTime:  time.Duration(0),
+			SuccSum:  0,
+			Success:  false,
+		})
+	}
+}
+
+// firstTTL returns FirstTTL, 1 when it is not set.
+func (t *TraceRoute) firstTTL() int {
+	if t.FirstTTL < 1 {
+		return 1
+	}
+	return t.FirstTTL
+}
+
+// icmpFlowKey is the flow key shared by every ICMP echo probe of the trace.
+func (t *TraceRoute) icmpFlowKey() string {
+	if t.Af == "ip6" {
+		return GetHash(t.NetSrcAddr.To16(), t.NetDstAddr.To16(), 65535, 65535, protocolIPv6ICMP)
+	}
+	return GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, protocolICMP)
+}
+
 func (t *TraceRoute) validateSrcAddress() error {
 	if t.SrcAddr != "" {
 		addr, err := net.ResolveIPAddr(t.Af, t.SrcAddr)
@@ -103,6 +266,15 @@ func (t *TraceRoute) validateSrcAddress() error {
 
 	if t.Af == "ip6" {
 		t.SrcAddr = "::"
+		// 取出站的源地址，用于计算flow key和展示
+		t.NetSrcAddr = net.IPv6unspecified
+		conn, err := net.Dial("udp6", net.JoinHostPort(t.NetDstAddr.String(), "33434"))
+		if err != nil {
+			// 没有到目的地址的路由，用::算出来的flow key收不到任何回复
+			return err
+		}
+		defer conn.Close()
+		t.NetSrcAddr = conn.LocalAddr().(*net.UDPAddr).IP
 		return nil
 	}
 
@@ -141,18 +313,41 @@ func (t *TraceRoute) VerifyCfg() error {
 
 	if t.Count > 32 {
 		logrus.Error("Only support max ECMP = 32")
-		return fmt.Errorf("Only support max ECMP = 32")
+		return &ConfigError{"Count", "only support max ECMP = 32"}
 	}
-	if t.MaxTTL > 64 {
-		logrus.Warn("Large TTL may cause low performance")
-		return fmt.Errorf("Large TTL may cause low performance")
+	if t.MaxTTL > maxTTL {
+		logrus.Warn("TTL is larger than 255")
+		return &ConfigError{"MaxTTL", fmt.Sprintf("must be at most %d", maxTTL)}
 	}
 
 	return nil
 }
 
+// New creates a trace from positional arguments; timeout is in seconds.
+// NewWithConfig reaches every TraceRoute setting.
+// The arguments go through Config, so a zero count, interval or timeout takes
+// the Config default (3 probes, 100ms, 2s) rather than being used as is, and
+// an unsupported protocol, address family or ping type fails here with a
+// *ConfigError rather than when the trace runs.
 func New(protocol string, dest string, src string, af string, count int, interval time.Duration, timeout int64,
 	pingType string) (result *TraceRoute, err error) {
+	return NewWithConfig(Config{
+		Protocol:   protocol,
+		Dest:       dest,
+		Src:        src,
+		Af:         af,
+		PingType:   pingType,
+		Count:      count,
+		Interval:   interval,
+		Timeout:    time.Duration(timeout) * time.Second,
+		WideMode:   true,
+		PortOffset: 0,
+	})
+}
+
+// NewWithConfig validates cfg, resolves the addresses and returns a trace
+// ready to Run. Invalid fields are reported as *ConfigError.
+func NewWithConfig(cfg Config) (result *TraceRoute, err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			logrus.Error(e)
@@ -161,24 +356,48 @@ func New(protocol string, dest string, src string, af string, count int, interva
 			err = fmt.Errorf("panic recovered: %s\n %s", e, buf)
 		}
 	}()
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		logrus.Error("Config validation failed: ", err)
+		return nil, err
+	}
+
 	result = &TraceRoute{
-		PingType:      pingType,
-		SrcAddr:       src,
-		Dest:          dest,
-		Af:            af,
-		TCPDPort:      443,
-		TCPProbePorts: []uint16{80, 8080, 443, 8443},
-		Protocol:      protocol,
-		Count:         count,
-		Interval:      interval,
-		MaxTTL:        30,
-		PacketRate:    1,
-		WideMode:      true,
-		PortOffset:    0,
-		Timeout:       time.Duration(timeout) * time.Second,
-		LastHop:       0,
-		GlobalTimeout: time.Now().Add(20 * time.Second),
-		HopDetail:     make([]HopInfo, 0),
+		PingType:         cfg.PingType,
+		SrcAddr:          cfg.Src,
+		Dest:             cfg.Dest,
+		Af:               cfg.Af,
+		TCPDPort:         cfg.TCPDPort,
+		TCPProbePorts:    cfg.TCPProbePorts,
+		TCPMultiPort:     cfg.TCPMultiPort,
+		Protocol:         cfg.Protocol,
+		Count:            cfg.Count,
+		Interval:         cfg.Interval,
+		FirstTTL:         cfg.FirstTTL,
+		MaxTTL:           cfg.MaxTTL,
+		PacketRate:       cfg.PacketRate,
+		WideMode:         cfg.WideMode,
+		PortOffset:       cfg.PortOffset,
+		Paris:            cfg.Paris,
+		MDA:              cfg.MDA,
+		MDAConfidence:    cfg.MDAConfidence,
+		GapLimit:         cfg.GapLimit,
+		TOS:              cfg.TOS,
+		PMTU:             cfg.PMTU,
+		MTU:              cfg.MTU,
+		pathMTU:          cfg.MTU,
+		Continuous:       cfg.Continuous,
+		WindowCycles:     cfg.WindowCycles,
+		WindowTime:       cfg.WindowTime,
+		SnapshotInterval: cfg.SnapshotInterval,
+		Transport:        cfg.Transport,
+		Observer:         cfg.Observer,
+		Timeout:          cfg.Timeout,
+		LastHop:          0,
+		HopDetail:        make([]HopInfo, 0),
+	}
+	if cfg.GlobalTimeout > 0 {
+		result.GlobalTimeout = time.Now().Add(cfg.GlobalTimeout)
 	}
 
 	if err := result.VerifyCfg(); err != nil {
@@ -186,65 +405,73 @@ func New(protocol string, dest string, src string, af string, count int, interva
 		return nil, err
 	}
 	result.Lock = &sync.RWMutex{}
-	result.Metric = make([]*ServerRecord, 65)
-	for i := 1; i <= 64; i++ {
-		result.Metric[i] = &ServerRecord{
-			TTL:      uint8(i),
-			Addr:     "???",
-			Name:     "",
-			Session:  "",
-			RecvCnt:  0,
-			Lock:     &sync.Mutex{},
-			Loss:     100,
-			LastTime: time.Duration(0),
-			WrstTime: time.Duration(0),
-			BestTime: time.Duration(0),
-			AvgTime:  time.Duration(0),
-			AllTime:  time.Duration(0),
-			SuccSum:  0,
-			Success:  false,
-		}
-	}
+	result.sizeMetric()
 	return result, nil
 }
 
 func (t *TraceRoute) TraceUDP() (err error) {
 	var handlers []func() error
 
+	// 先打开接收的socket再发包，否则第一跳的回复可能比socket先到
+	conn, err := t.listenIPv4ICMP()
+	if err != nil {
+		return err
+	}
+	handlers = append(handlers, func() error {
+		return t.recvIPv4ICMP(conn)
+	})
+
+	t.markStart()
 	for i := 0; i < t.Count; i++ {
 		handlers = append(handlers, func() error {
 			return t.SendIPv4UDP()
 		})
 	}
 
-	handlers = append(handlers, func() error {
-		return t.ListenIPv4ICMP()
-	})
-
 	return GoroutineNotPanic(handlers...)
 }
 
 func (t *TraceRoute) TraceTCP() (err error) {
 	var handlers []func() error
 
-	for i := 0; i < t.Count; i++ {
-		handlers = append(handlers, func() error {
-			return t.SendIPv4TCP()
-		})
+	conn, err := t.listenIPv4ICMP()
+	if err != nil {
+		return err
 	}
-
+	tcpConn, rSocket, err := t.listenIPv4TCP()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	handlers = append(handlers, func() error {
+		return t.recvIPv4ICMP(conn)
+	})
 	handlers = append(handlers, func() error {
-		return t.ListenIPv4ICMP()
+		return t.recvIPv4TCP(tcpConn, rSocket)
 	})
 
+	t.markStart()
+	for _, port := range t.probePorts() {
+		port := port
+		for i := 0; i < t.Count; i++ {
+			handlers = append(handlers, func() error {
+				return t.sendIPv4TCP(port)
+			})
+		}
+	}
+
 	return GoroutineNotPanic(handlers...)
 }
 
 func (t *TraceRoute) TraceICMP() (err error) {
 	var handlers []func() error
 
+	conn, err := t.listenIPv4ICMP()
+	if err != nil {
+		return err
+	}
 	handlers = append(handlers, func() error {
-		return t.ListenIPv4ICMP()
+		return t.recvIPv4ICMP(conn)
 	})
 
 	handlers = append(handlers, func() error {
@@ -257,8 +484,12 @@ func (t *TraceRoute) TraceICMP() (err error) {
 func (t *TraceRoute) TraceWindowsICMP() (err error) {
 	var handlers []func() error
 
+	conn, err := t.listenWindowsIPv4ICMP()
+	if err != nil {
+		return err
+	}
 	handlers = append(handlers, func() error {
-		return t.ListenWindowsIPv4ICMP()
+		return t.recvWindowsIPv4ICMP(conn)
 	})
 
 	handlers = append(handlers, func() error {
@@ -268,9 +499,61 @@ func (t *TraceRoute) TraceWindowsICMP() (err error) {
 	return GoroutineNotPanic(handlers...)
 }
 
+// Run runs the trace until it finishes or GlobalTimeout passes. A Continuous
+// trace only ends with GlobalTimeout, use RunContext to stop it.
 func (t *TraceRoute) Run() error {
+	return t.RunContext(context.Background())
+}
+
+// RunContext runs the trace until it finishes or ctx is done. Once ctx is
+// cancelled or its deadline passes, every sender and listener stops, the raw
+// sockets are closed and the results collected so far are kept; the returned
+// error is then ctx.Err().
+func (t *TraceRoute) RunContext(ctx context.Context) error {
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	defer t.cancel()
+	t.sizeMetric()
+	// 快照和接收循环都会读StartTime，在它们启动前设置好
+	t.StartTime = time.Now()
+
+	done := make(chan struct{})
+	if t.SnapshotInterval > 0 {
+		go func() {
+			defer close(done)
+			t.snapshots()
+		}()
+	} else {
+		close(done)
+	}
+	err := t.run()
+	t.cancel()
+	<-done
+	// 结束时仍未收到回复的包都算作丢包，再重新生成报告
+	t.expirePending()
+	t.Statistics()
+	t.finish()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (t *TraceRoute) run() error {
+	if t.MDA {
+		return t.TraceMDA()
+	}
+	if t.PMTU {
+		return t.TracePMTU()
+	}
 	if t.Af == "ip6" {
-		return t.TraceIpv6ICMP()
+		switch t.Protocol {
+		case "udp":
+			return t.TraceIpv6UDP()
+		case "tcp":
+			return t.TraceIpv6TCP()
+		default:
+			return t.TraceIpv6ICMP()
+		}
 	}
 
 	switch t.Protocol {
@@ -294,6 +577,53 @@ func (t *TraceRoute) Run() error {
 
 }
 
+// context returns the context of the running trace, or a background context
+// when the senders and listeners are driven without RunContext.
+func (t *TraceRoute) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// markStart sets StartTime when the trace was not started by RunContext,
+// which sets it before anything reads it.
+func (t *TraceRoute) markStart() {
+	if t.StartTime.IsZero() {
+		t.StartTime = time.Now()
+	}
+}
+
+// stopped reports whether the trace context is done.
+func (t *TraceRoute) stopped() bool {
+	return t.context().Err() != nil
+}
+
+// sleep waits for d and reports false if the trace context is done first.
+func (t *TraceRoute) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-t.context().Done():
+		return false
+	}
+}
+
+// closeOnDone closes c once the trace context is done, so that reads blocked
+// on a raw socket return immediately.
+func (t *TraceRoute) closeOnDone(c io.Closer) {
+	done := t.context().Done()
+	if done == nil {
+		return
+	}
+	go func() {
+		<-done
+		c.Close()
+	}()
+}
+
 func GoroutineNotPanic(handlers ...func() error) (err error) {
 	var wg sync.WaitGroup
 
@@ -1,6 +1,8 @@
 package ztrace
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 )
@@ -31,3 +33,46 @@ func TestTrace(t *testing.T) {
 	//fmt.Println(ret)
 	//fmt.Println(c.HopStr)
 }
+
+func TestRunContextCancel(t *testing.T) {
+	b := &blackHole{}
+	tr, err := NewWithConfig(Config{
+		Dest:       "198.51.100.1",
+		Src:        "192.0.2.1",
+		Count:      1,
+		Interval:   10 * time.Millisecond,
+		Timeout:    100 * time.Millisecond,
+		Continuous: true,
+		Transport:  b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- tr.RunContext(ctx) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("RunContext returned %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunContext did not return after its context was done")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("RunContext took %v to stop", d)
+	}
+
+	// 取消后不再发包
+	sent := len(b.sent())
+	if sent == 0 {
+		t.Fatal("no probe sent")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := len(b.sent()); n != sent {
+		t.Errorf("%v probes sent after RunContext returned", n-sent)
+	}
+}
@@ -0,0 +1,159 @@
+package ztrace
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ControlMessage carries the per-packet IP header fields of a PacketConn.
+type ControlMessage struct {
+	TTL int // TTL or hop limit, 0 keeps the socket default on write and means unknown on read
+	TOS int // TOS or traffic class to write, 0 keeps the socket default
+	// DontFragment keeps an IPv6 packet larger than the link MTU from being
+	// fragmented by the sender, the write fails with EMSGSIZE instead.
+	DontFragment bool
+}
+
+// PacketConn is a socket on which the kernel builds the IP header. It is used
+// for ICMP and ICMPv6 echo probes and for reading ICMP replies.
+type PacketConn interface {
+	ReadFrom(b []byte) (n int, cm *ControlMessage, src net.Addr, err error)
+	WriteTo(b []byte, cm *ControlMessage, dst net.Addr) (n int, err error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// RawConn is an IPv4 raw socket that sends probes with a caller built header.
+type RawConn interface {
+	WriteTo(h *ipv4.Header, p []byte, cm *ipv4.ControlMessage) error
+	Close() error
+}
+
+// Transport opens the sockets a trace sends probes on and reads replies from.
+type Transport interface {
+	// ListenPacket opens a PacketConn on network, one of ip4:icmp, udp4,
+	// ip6:ipv6-icmp, udp6 or another IP network accepted by net.ListenPacket.
+	ListenPacket(network, address string) (PacketConn, error)
+	// ListenRaw opens a RawConn on network, one of ip4:icmp, ip4:udp or ip4:tcp.
+	ListenRaw(network, address string) (RawConn, error)
+}
+
+// SystemTransport is the Transport backed by the operating system sockets,
+// used when TraceRoute.Transport is nil.
+var SystemTransport Transport = systemTransport{}
+
+type systemTransport struct{}
+
+func (systemTransport) ListenPacket(network, address string) (PacketConn, error) {
+	switch network {
+	case "ip4:icmp", "udp4", "ip6:ipv6-icmp", "udp6":
+		c, err := icmp.ListenPacket(network, address)
+		if err != nil {
+			return nil, err
+		}
+		if p := c.IPv6PacketConn(); p != nil {
+			return newIPv6PacketConn(c, p), nil
+		}
+		return newIPv4PacketConn(c, c.IPv4PacketConn()), nil
+	}
+
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(network, "ip6") || strings.HasSuffix(network, "6") {
+		return newIPv6PacketConn(c, ipv6.NewPacketConn(c)), nil
+	}
+	return newIPv4PacketConn(c, ipv4.NewPacketConn(c)), nil
+}
+
+func (systemTransport) ListenRaw(network, address string) (RawConn, error) {
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ipv4.NewRawConn(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+type packetConn struct {
+	net.PacketConn
+	p4       *ipv4.PacketConn
+	p6       *ipv6.PacketConn
+	dontFrag bool // IPV6_DONTFRAG is set
+}
+
+func newIPv4PacketConn(c net.PacketConn, p *ipv4.PacketConn) *packetConn {
+	// Not every platform reports the TTL of received packets, it stays 0 there.
+	p.SetControlMessage(ipv4.FlagTTL, true)
+	return &packetConn{PacketConn: c, p4: p}
+}
+
+func newIPv6PacketConn(c net.PacketConn, p *ipv6.PacketConn) *packetConn {
+	p.SetControlMessage(ipv6.FlagHopLimit, true)
+	return &packetConn{PacketConn: c, p6: p}
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, *ControlMessage, net.Addr, error) {
+	if c.p6 != nil {
+		n, cm, src, err := c.p6.ReadFrom(b)
+		if cm == nil {
+			return n, nil, src, err
+		}
+		return n, &ControlMessage{TTL: cm.HopLimit}, src, err
+	}
+	n, cm, src, err := c.p4.ReadFrom(b)
+	if cm == nil {
+		return n, nil, src, err
+	}
+	return n, &ControlMessage{TTL: cm.TTL}, src, err
+}
+
+func (c *packetConn) WriteTo(b []byte, cm *ControlMessage, dst net.Addr) (int, error) {
+	if c.p6 != nil {
+		if cm != nil && cm.TTL > 0 {
+			if err := c.p6.SetHopLimit(cm.TTL); err != nil {
+				return 0, err
+			}
+		}
+		if cm != nil && cm.TOS > 0 {
+			if err := c.p6.SetTrafficClass(cm.TOS); err != nil {
+				return 0, err
+			}
+		}
+		if cm != nil && cm.DontFragment && !c.dontFrag {
+			if err := setDontFragment6(c.PacketConn); err != nil {
+				return 0, err
+			}
+			c.dontFrag = true
+		}
+		return c.p6.WriteTo(b, nil, dst)
+	}
+	if cm != nil && cm.TTL > 0 {
+		if err := c.p4.SetTTL(cm.TTL); err != nil {
+			return 0, err
+		}
+	}
+	if cm != nil && cm.TOS > 0 {
+		if err := c.p4.SetTOS(cm.TOS); err != nil {
+			return 0, err
+		}
+	}
+	return c.p4.WriteTo(b, nil, dst)
+}
+
+func (t *TraceRoute) transport() Transport {
+	if t.Transport == nil {
+		return SystemTransport
+	}
+	return t.Transport
+}
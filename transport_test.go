@@ -0,0 +1,107 @@
+package ztrace
+
+import (
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blackHole is a Transport whose probes all vanish: writes are recorded and
+// reads time out until the socket is closed.
+type blackHole struct {
+	mu       sync.Mutex
+	networks []string
+	ttls     []int
+}
+
+func (b *blackHole) ListenPacket(network, address string) (PacketConn, error) {
+	b.mu.Lock()
+	b.networks = append(b.networks, network)
+	b.mu.Unlock()
+	return &blackHoleConn{b: b, closed: make(chan struct{})}, nil
+}
+
+func (b *blackHole) ListenRaw(network, address string) (RawConn, error) {
+	return nil, &net.OpError{Op: "listen", Net: network, Err: os.ErrPermission}
+}
+
+func (b *blackHole) sent() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]int(nil), b.ttls...)
+}
+
+type blackHoleConn struct {
+	b        *blackHole
+	mu       sync.Mutex
+	deadline time.Time
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func (c *blackHoleConn) ReadFrom(p []byte) (int, *ControlMessage, net.Addr, error) {
+	c.mu.Lock()
+	d := time.Until(c.deadline)
+	c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return 0, nil, nil, &net.OpError{Op: "read", Err: net.ErrClosed}
+	case <-time.After(d):
+		return 0, nil, nil, &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+	}
+}
+
+func (c *blackHoleConn) WriteTo(p []byte, cm *ControlMessage, dst net.Addr) (int, error) {
+	c.b.mu.Lock()
+	c.b.ttls = append(c.b.ttls, cm.TTL)
+	c.b.mu.Unlock()
+	return len(p), nil
+}
+
+func (c *blackHoleConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *blackHoleConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	b := &blackHole{}
+	tr, err := NewWithConfig(Config{
+		Dest:      "198.51.100.1",
+		Src:       "192.0.2.1",
+		Count:     1,
+		Interval:  10 * time.Millisecond,
+		Timeout:   100 * time.Millisecond,
+		MaxTTL:    3,
+		Transport: b,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, network := range b.networks {
+		if network != "ip4:icmp" {
+			t.Errorf("listened on %v, want ip4:icmp", network)
+		}
+	}
+	ttls := b.sent()
+	sort.Ints(ttls)
+	if len(ttls) != 3 || ttls[0] != 1 || ttls[2] != 3 {
+		t.Errorf("probes sent with TTLs %v, want 1 to 3", ttls)
+	}
+	if r := tr.Result(); r.Reached {
+		t.Errorf("destination reached through a black hole")
+	}
+}
@@ -2,6 +2,7 @@
 package tsyncmap
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -19,6 +20,8 @@ type Map struct {
 	CheckFreq  int64
 	ExpireTime sync.Map
 	Verbose    bool
+	// OnExpire, if set, is called by Run for every entry that expires.
+	OnExpire func(key, value interface{})
 }
 
 //NewMap is a construct function to create tsyncmap.
@@ -100,6 +103,12 @@ func (tmap *Map) UpdateTime(key interface{}, currentTime time.Time) {
 	tmap.ExpireTime.Store(key, expireTime)
 }
 
+//LoadAndDelete deletes the key and returns its previous value if any.
+func (tmap *Map) LoadAndDelete(key interface{}) (value interface{}, loaded bool) {
+	tmap.ExpireTime.Delete(key)
+	return tmap.Data.LoadAndDelete(key)
+}
+
 func (tmap *Map) Delete(key interface{}) {
 	tmap.Data.Delete(key)
 	tmap.ExpireTime.Delete(key)
@@ -107,16 +116,32 @@ func (tmap *Map) Delete(key interface{}) {
 
 //Run is a coroutine to help tsyncmap manage the expire data.
 func (tmap *Map) Run() {
+	tmap.RunContext(context.Background())
+}
+
+//RunContext is like Run but returns once ctx is done.
+func (tmap *Map) RunContext(ctx context.Context) {
 	rand.Seed(time.Now().UnixNano())
 	r := tmap.CheckFreq / 5
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
 		currentTime := time.Now()
 		tmap.ExpireTime.Range(func(k, v interface{}) bool {
 			value := v.(time.Time)
 			if value.Sub(currentTime) < 0 {
 				//fmt.Println("DEBUG:::DELETE-KEY", reflect.ValueOf(k))
-				tmap.Data.Delete(k)
+				data, loaded := tmap.Data.LoadAndDelete(k)
 				tmap.ExpireTime.Delete(k)
+				if loaded && tmap.OnExpire != nil {
+					tmap.OnExpire(k, data)
+				}
 			}
 			return true
 		})
@@ -124,7 +149,7 @@ func (tmap *Map) Run() {
 			tmap.ShowExpireTime()
 			tmap.ShowData()
 		}
-		time.Sleep(time.Duration(tmap.CheckFreq + rand.Int63n(r)))
+		timer.Reset(time.Duration(tmap.CheckFreq + rand.Int63n(r)))
 	}
 }
 
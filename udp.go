@@ -1,108 +1,66 @@
 package ztrace
 
 import (
-	"encoding/binary"
 	"math/rand"
-	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"golang.org/x/net/ipv4"
 )
 
 func (t *TraceRoute) SendIPv4UDP() error {
 	dport := uint16(33434 + rand.Int31n(64))
-	sport := uint16(1000 + t.PortOffset + rand.Int31n(500))
+	sport, key, db := t.newPortFlow(17, dport)
 
-	key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), sport, dport, 17)
-	db := NewStatsDB(key)
-
-	t.DB.Store(key, db)
-	go db.Cache.Run()
-
-	conn, err := net.ListenPacket("ip4:udp", t.NetSrcAddr.String())
-	if err != nil {
-		logrus.Error(err)
-		return err
-	}
-	defer conn.Close()
-
-	rSocket, err := ipv4.NewRawConn(conn)
+	rSocket, err := t.transport().ListenRaw("ip4:udp", t.NetSrcAddr.String())
 	if err != nil {
 		logrus.Error("can not create raw socket:", err)
 		return err
 	}
 	defer rSocket.Close()
+	t.closeOnDone(rSocket)
 
 	id := uint16(1)
 	mod := uint16(1 << 15)
 
-	for ttl := 1; ttl <= int(t.MaxTTL); ttl++ {
-		hdr, payload := t.BuildIPv4UDPkt(sport, dport, uint8(ttl), id, 0)
-		id = (id + 1) % mod
-		rSocket.WriteTo(hdr, payload, nil)
-
-		m := &SendMetric{
-			FlowKey:   key,
-			ID:        uint32(hdr.ID),
-			TTL:       uint8(ttl),
-			TimeStamp: time.Now(),
+	for cycle := 0; t.moreCycles(cycle, 1); cycle++ {
+		if cycle > 0 && !t.sleep(t.Interval) {
+			return nil
 		}
+		t.startCycle(cycle)
+		for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+			if t.skip(key, cycle, ttl) {
+				continue
+			}
+			if !t.pace() {
+				return nil
+			}
+			hdr, payload := t.BuildIPv4UDPkt(sport, dport, uint8(ttl), id, t.TOS)
+			// Paris模式下ID放在校验和里，而校验和不会是0
+			if id = (id + 1) % mod; id == 0 {
+				id = 1
+			}
+			m := &SendMetric{
+				FlowKey:   key,
+				ID:        uint32(hdr.ID),
+				TTL:       uint8(ttl),
+				TimeStamp: time.Now(),
+				Cycle:     cycle,
+			}
 
-		t.RecordSend(m)
+			// 先记下再发，回复可能比RecordSend先到
+			atomic.AddUint64(db.SendCnt, 1)
+			t.RecordSend(m)
+			rSocket.WriteTo(hdr, payload, nil)
+		}
 	}
-	t.StartTime = time.Now()
 
 	return nil
 }
 
+// ListenIPv4UDP_ICMP receives the ICMP replies to UDP probes.
+//
+// Deprecated: ListenIPv4ICMP handles the replies of every protocol.
 func (t *TraceRoute) ListenIPv4UDP_ICMP() error {
-	laddr := &net.IPAddr{IP: t.NetSrcAddr}
-
-	var err error
-	t.recvICMPConn, err = net.ListenIP("ip4:icmp", laddr)
-
-	if err != nil {
-		logrus.Error("bind failure:", err)
-		return err
-	}
-	defer t.recvICMPConn.Close()
-
-	t.recvICMPConn.SetReadDeadline(time.Now().Add(t.Timeout))
-
-	for {
-		buf := make([]byte, 1500)
-
-		n, raddr, err := t.recvICMPConn.ReadFrom(buf)
-		if err != nil {
-			break
-		}
-
-		icmpType := buf[0]
-
-		if (raddr.String() == t.NetDstAddr.String() || icmpType == 11 || (icmpType == 3 && buf[1] == 3)) && (n >= 36) {
-			id := binary.BigEndian.Uint16(buf[12:14])
-			dstip := net.IP(buf[24:28])
-			srcip := net.IP(buf[20:24])
-			srcPort := binary.BigEndian.Uint16(buf[28:30])
-			dstPort := binary.BigEndian.Uint16(buf[30:32])
-
-			if dstip.Equal(t.NetDstAddr) {
-				key := GetHash(srcip, dstip, srcPort, dstPort, 17)
-
-				m := &RecvMetric{
-					FlowKey:   key,
-					ID:        uint32(id),
-					RespAddr:  raddr.String(),
-					TimeStamp: time.Now(),
-				}
-
-				t.RecordRecv(m)
-			}
-		}
-	}
-
-	t.Statistics()
-
-	return nil
+	return t.ListenIPv4ICMP()
 }
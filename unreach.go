@@ -0,0 +1,128 @@
+package ztrace
+
+import (
+	"fmt"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Unreachable is an ICMP error other than Time Exceeded: a Destination
+// Unreachable, Packet Too Big or Parameter Problem. Probes of the same flow
+// with a higher TTL would meet the same fate, so the flow stops at the hop
+// that sent it.
+// Marker is the annotation traceroute prints for it, like !H or !X.
+type Unreachable struct {
+	Type   int    `json:"type"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+	Marker string `json:"marker"`
+}
+
+type unreachCode struct {
+	reason, marker string
+}
+
+// unreach4 and unreach6 are the codes of Destination Unreachable, from RFC
+// 792 and RFC 1812, and RFC 4443.
+var unreach4 = map[int]unreachCode{
+	0:  {"network unreachable", "!N"},
+	1:  {"host unreachable", "!H"},
+	2:  {"protocol unreachable", "!P"},
+	3:  {"port unreachable", ""},
+	4:  {"fragmentation needed", "!F"},
+	5:  {"source route failed", "!S"},
+	6:  {"destination network unknown", "!N"},
+	7:  {"destination host unknown", "!H"},
+	8:  {"source host isolated", "!H"},
+	9:  {"network administratively prohibited", "!X"},
+	10: {"host administratively prohibited", "!X"},
+	11: {"network unreachable for TOS", "!N"},
+	12: {"host unreachable for TOS", "!H"},
+	13: {"communication administratively prohibited", "!X"},
+	14: {"host precedence violation", "!V"},
+	15: {"precedence cutoff in effect", "!C"},
+}
+
+var unreach6 = map[int]unreachCode{
+	0: {"no route to destination", "!N"},
+	1: {"communication administratively prohibited", "!X"},
+	2: {"beyond scope of source address", "!S"},
+	3: {"address unreachable", "!H"},
+	4: {"port unreachable", ""},
+	5: {"source address failed ingress/egress policy", "!X"},
+	6: {"reject route to destination", "!X"},
+}
+
+// classify returns the Unreachable of an ICMP error of type typ and code, or
+// nil when it is a Time Exceeded or an echo reply. Codes missing from the
+// tables are marked like traceroute does, !<code>.
+func classify(af string, typ, code int) *Unreachable {
+	u := &Unreachable{Type: typ, Code: code}
+	var c unreachCode
+	var ok bool
+	if af == "ip6" {
+		switch ipv6.ICMPType(typ) {
+		case ipv6.ICMPTypeDestinationUnreachable:
+			c, ok = unreach6[code]
+			if !ok {
+				c = unreachCode{"destination unreachable", fmt.Sprintf("!<%d>", code)}
+			}
+		case ipv6.ICMPTypePacketTooBig:
+			c = unreachCode{"packet too big", "!F"}
+		case ipv6.ICMPTypeParameterProblem:
+			c = unreachCode{"parameter problem", fmt.Sprintf("!<%d.%d>", typ, code)}
+		default:
+			return nil
+		}
+	} else {
+		switch ipv4.ICMPType(typ) {
+		case ipv4.ICMPTypeDestinationUnreachable:
+			c, ok = unreach4[code]
+			if !ok {
+				c = unreachCode{"destination unreachable", fmt.Sprintf("!<%d>", code)}
+			}
+		case ipv4.ICMPTypeParameterProblem:
+			c = unreachCode{"parameter problem", fmt.Sprintf("!<%d.%d>", typ, code)}
+		default:
+			return nil
+		}
+	}
+	u.Reason, u.Marker = c.reason, c.marker
+	return u
+}
+
+// String formats u like the reason of an mtr hop, e.g. "!X (communication
+// administratively prohibited)".
+func (u Unreachable) String() string {
+	if u.Marker == "" {
+		return u.Reason
+	}
+	return fmt.Sprintf("%v (%v)", u.Marker, u.Reason)
+}
+
+// unreachable returns the Unreachable of an ICMP error that addr answered a
+// probe with, or nil when the probe went on or was answered as expected: the
+// port unreachable of the destination marks it reached.
+func (t *TraceRoute) unreachable(addr string, typ, code int) *Unreachable {
+	u := classify(t.Af, typ, code)
+	if u == nil || (u.Marker == "" && addr == t.NetDstAddr.String()) {
+		return nil
+	}
+	return u
+}
+
+// endsPath reports whether the hop at ttl, whose view is server, ends the
+// path: a responder answered with an Unreachable and no flow goes past it.
+// The caller holds server.Lock.
+func (t *TraceRoute) endsPath(ttl int, server *ServerRecord) bool {
+	if ttl < t.maxFlowStop() {
+		return false
+	}
+	for _, r := range server.Responders {
+		if r.Unreachable != nil {
+			return true
+		}
+	}
+	return false
+}
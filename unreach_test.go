@@ -0,0 +1,57 @@
+package ztrace
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		af        string
+		typ, code int
+		unreach   bool
+		marker    string
+		reason    string
+	}{
+		{"ip4", 11, 0, false, "", ""},
+		{"ip4", 0, 0, false, "", ""},
+		{"ip4", 3, 3, true, "", "port unreachable"},
+		{"ip4", 3, 1, true, "!H", "host unreachable"},
+		{"ip4", 3, 13, true, "!X", "communication administratively prohibited"},
+		{"ip4", 3, 99, true, "!<99>", "destination unreachable"},
+		{"ip4", 12, 0, true, "!<12.0>", "parameter problem"},
+		{"ip6", 3, 0, false, "", ""},
+		{"ip6", 129, 0, false, "", ""},
+		{"ip6", 1, 1, true, "!X", "communication administratively prohibited"},
+		{"ip6", 1, 4, true, "", "port unreachable"},
+		{"ip6", 1, 9, true, "!<9>", "destination unreachable"},
+		{"ip6", 2, 0, true, "!F", "packet too big"},
+		{"ip6", 4, 1, true, "!<4.1>", "parameter problem"},
+	}
+	for _, tt := range tests {
+		u := classify(tt.af, tt.typ, tt.code)
+		if !tt.unreach {
+			if u != nil {
+				t.Errorf("classify(%v, %v, %v) = %v, want nil", tt.af, tt.typ, tt.code, u)
+			}
+			continue
+		}
+		if u == nil || u.Marker != tt.marker || u.Reason != tt.reason {
+			t.Errorf("classify(%v, %v, %v) = %+v, want marker %q reason %q", tt.af, tt.typ, tt.code, u, tt.marker, tt.reason)
+		}
+	}
+}
+
+func TestUnreachablePort(t *testing.T) {
+	tr := &TraceRoute{Af: "ip4", NetDstAddr: net.ParseIP("198.51.100.1")}
+	// 目的地址回的端口不可达代表到达，不算Unreachable
+	if u := tr.unreachable("198.51.100.1", 3, 3); u != nil {
+		t.Errorf("port unreachable from the destination = %v, want nil", u)
+	}
+	if u := tr.unreachable("10.0.0.1", 3, 3); u == nil {
+		t.Errorf("port unreachable from a router = nil, want an Unreachable")
+	}
+	if u := tr.unreachable("198.51.100.1", 3, 10); u == nil || u.String() != "!X (host administratively prohibited)" {
+		t.Errorf("host prohibited from the destination = %v, want !X", u)
+	}
+}
@@ -0,0 +1,149 @@
+package ztrace
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// defaultWindowCycles is the stats window of a continuous trace that sets
+// neither WindowCycles nor WindowTime, so that it runs in bounded memory.
+const defaultWindowCycles = 100
+
+// moreCycles reports whether a sender that has done cycle rounds out of n
+// starts another one: always in continuous mode, until stopped.
+func (t *TraceRoute) moreCycles(cycle, n int) bool {
+	return t.Continuous || cycle < n
+}
+
+// startCycle records that a sender started round cycle.
+func (t *TraceRoute) startCycle(cycle int) {
+	for {
+		cur := atomic.LoadInt64(&t.cycle)
+		if int64(cycle) <= cur || atomic.CompareAndSwapInt64(&t.cycle, cur, int64(cycle)) {
+			return
+		}
+	}
+}
+
+// windowed reports whether hop stats cover a sliding window instead of the
+// whole trace.
+func (t *TraceRoute) windowed() bool {
+	return t.WindowCycles > 0 || t.WindowTime > 0
+}
+
+// inWindow reports whether s belongs to the last WindowCycles rounds and
+// was sent less than WindowTime before now.
+func (t *TraceRoute) inWindow(s ProbeSample, now time.Time) bool {
+	if t.WindowCycles > 0 && int64(s.Cycle) <= atomic.LoadInt64(&t.cycle)-int64(t.WindowCycles) {
+		return false
+	}
+	if t.WindowTime > 0 && now.Sub(s.SentAt) > t.WindowTime {
+		return false
+	}
+	return true
+}
+
+// addSample appends s to the samples of server and drops the ones that left
+// the window; the caller holds server.Lock.
+func (t *TraceRoute) addSample(server *ServerRecord, s ProbeSample) {
+	server.Samples = append(server.Samples, s)
+	if !t.windowed() {
+		return
+	}
+	now := time.Now()
+	// 样本大致按时间排列，最早的还在窗口内就不用整理
+	if t.inWindow(server.Samples[0], now) {
+		return
+	}
+	kept := server.Samples[:0]
+	for _, s := range server.Samples {
+		if t.inWindow(s, now) {
+			kept = append(kept, s)
+		}
+	}
+	server.Samples = kept
+}
+
+// view returns the stats of server over the window, replayed from the
+// samples in it, or server itself when the trace keeps all-time stats; the
+// caller holds server.Lock. Probes still in flight are not in the window.
+func (t *TraceRoute) view(server *ServerRecord) *ServerRecord {
+	if !t.windowed() {
+		return server
+	}
+	now := time.Now()
+	var samples []ProbeSample
+	for _, s := range server.Samples {
+		if t.inWindow(s, now) {
+			samples = append(samples, s)
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].SentAt.Before(samples[j].SentAt)
+	})
+
+	v := &ServerRecord{
+		TTL:     server.TTL,
+		Addr:    "???",
+		Lock:    server.Lock,
+		Loss:    100,
+		SendCnt: uint64(len(samples)),
+		Samples: samples,
+	}
+	for _, s := range samples {
+		if s.Received {
+			v.recv(s.Flow, s.Responder, time.Duration(s.RTTMs*float64(time.Millisecond)))
+			if len(s.MPLS) > 0 {
+				v.responder(s.Responder).MPLS = s.MPLS
+			}
+			if len(s.InterfaceInfo) > 0 {
+				v.responder(s.Responder).InterfaceInfo = s.InterfaceInfo
+			}
+			if s.ReplyTTL > 0 {
+				v.responder(s.Responder).ReplyTTL = s.ReplyTTL
+			}
+			if s.QuotedTOS != nil {
+				v.responder(s.Responder).QuotedTOS = s.QuotedTOS
+			}
+			if u := t.unreachable(s.Responder, s.ICMPType, s.ICMPCode); u != nil {
+				v.responder(s.Responder).Unreachable = u
+			}
+		}
+	}
+	for _, s := range samples {
+		if s.Received {
+			continue
+		}
+		// 窗口内没有回复的flow按整个trace里最后的回复地址算
+		if _, ok := v.flowResponder[s.Flow]; !ok {
+			if r := server.flowResponder[s.Flow]; r != nil && v.hasResponder(r.Addr) {
+				if v.flowResponder == nil {
+					v.flowResponder = make(map[string]*ResponderRecord)
+				}
+				v.flowResponder[s.Flow] = v.responder(r.Addr)
+			}
+		}
+		v.lost(s.Flow)
+	}
+	return v
+}
+
+// snapshots emits a Snapshot event every SnapshotInterval until the trace
+// is stopped.
+func (t *TraceRoute) snapshots() {
+	ticker := time.NewTicker(t.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.context().Done():
+			return
+		case now := <-ticker.C:
+			t.emit(Event{
+				Type:     Snapshot,
+				Time:     now,
+				Snapshot: t.Result(),
+			})
+		}
+	}
+}
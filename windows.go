@@ -8,7 +8,6 @@ package ztrace
 
 import (
 	"golang.org/x/net/icmp"
-	"net"
 	"sync/atomic"
 	"time"
 
@@ -17,61 +16,86 @@ import (
 )
 
 func (t *TraceRoute) SendWindowsIPv4ICMP() error {
-	key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, 1)
-	db := NewStatsDB(key)
+	key := t.icmpFlowKey()
+	db := t.newFlow(key)
 
-	t.DB.Store(key, db)
-	go db.Cache.Run()
-
-	conn, err := net.ListenPacket("ip4:icmp", t.NetSrcAddr.String())
-	if err != nil {
-		logrus.Error(err)
-		return err
-	}
-	defer conn.Close()
-
-	rSocket, err := ipv4.NewRawConn(conn)
+	rSocket, err := t.transport().ListenRaw("ip4:icmp", t.NetSrcAddr.String())
 	if err != nil {
 		logrus.Error("can not create raw socket:", err)
 		return err
 	}
 	defer rSocket.Close()
-	t.StartTime = time.Now()
+	t.closeOnDone(rSocket)
+
+	t.markStart()
 	mod := uint16(1 << 15)
-	for snt := 0; snt < t.Count; snt++ {
-		id := uint16(1)
-		for ttl := 1; ttl <= t.MaxTTL; ttl++ {
-			hdr, payload := t.BuildIPv4ICMP(uint8(ttl), id, id, 0)
-			rSocket.WriteTo(hdr, payload, nil)
+	// IDs keep counting across rounds so that every probe has its own
+	// entry in the flow cache.
+	id := uint16(1)
+	for snt := 0; t.moreCycles(snt, t.Count); snt++ {
+		t.startCycle(snt)
+		for ttl := t.firstTTL(); ttl <= t.MaxTTL; ttl++ {
+			if t.skip(key, snt, ttl) {
+				continue
+			}
+			if !t.pace() {
+				return nil
+			}
+			hdr, payload := t.BuildIPv4ICMP(uint8(ttl), id, id, t.TOS)
 			m := &SendMetric{
 				FlowKey:   key,
 				ID:        uint32(hdr.ID),
 				TTL:       uint8(ttl),
 				TimeStamp: time.Now(),
+				Cycle:     snt,
 			}
+			// 先记下再发，回复可能比RecordSend先到
 			atomic.AddUint64(db.SendCnt, 1)
 			id = (id + 1) % mod
 			t.RecordSend(m)
+			rSocket.WriteTo(hdr, payload, nil)
 		}
 		// 100ms
-		time.Sleep(time.Millisecond * 100)
+		if !t.sleep(time.Millisecond * 100) {
+			return nil
+		}
 	}
 	return nil
 }
 
 func (t *TraceRoute) ListenWindowsIPv4ICMP() error {
-	laddr := &net.IPAddr{IP: t.NetSrcAddr}
-	conn, err := net.ListenIP("ip4:icmp", laddr)
+	conn, err := t.listenWindowsIPv4ICMP()
 	if err != nil {
-		logrus.Error("bind failure:", err)
 		return err
 	}
+	return t.recvWindowsIPv4ICMP(conn)
+}
+
+// listenWindowsIPv4ICMP opens the socket of ListenWindowsIPv4ICMP.
+func (t *TraceRoute) listenWindowsIPv4ICMP() (PacketConn, error) {
+	conn, err := t.transport().ListenPacket("ip4:icmp", t.NetSrcAddr.String())
+	if err != nil {
+		logrus.Error("bind failure:", err)
+		return nil, err
+	}
+	t.closeOnDone(conn)
+	return conn, nil
+}
+
+// recvWindowsIPv4ICMP is the receive loop of ListenWindowsIPv4ICMP; it closes
+// conn.
+func (t *TraceRoute) recvWindowsIPv4ICMP(conn PacketConn) error {
 	defer conn.Close()
+
 	for {
 		//conn.SetReadDeadline(time.Now().Add(t.Timeout))
 		buf := make([]byte, 1500)
-		n, raddr, err := conn.ReadFrom(buf)
+		n, cm, raddr, err := conn.ReadFrom(buf)
 		if err != nil {
+			if t.stopped() {
+				t.Statistics()
+				break
+			}
 			continue
 		}
 		if n == 0 {
@@ -81,18 +105,38 @@ func (t *TraceRoute) ListenWindowsIPv4ICMP() error {
 		if err != nil {
 			continue
 		}
-		if typ, ok := x.Type.(ipv4.ICMPType); ok && typ.String() == "time exceeded" {
-			body := x.Body.(*icmp.TimeExceeded).Data
-			x, _ := icmp.ParseMessage(1, body[20:])
+		// 超时、不可达和参数问题都带着原来的包
+		var body []byte
+		switch pkt := x.Body.(type) {
+		case *icmp.TimeExceeded:
+			body = pkt.Data
+		case *icmp.DstUnreach:
+			body = pkt.Data
+		case *icmp.ParamProb:
+			body = pkt.Data
+		}
+		if typ, ok := x.Type.(ipv4.ICMPType); ok && len(body) > 20 {
+			code := x.Code
+			mpls, ifInfo := mplsLabels(x.Body), interfaceInfo(x.Body)
+			x, err := icmp.ParseMessage(1, body[20:])
+			if err != nil {
+				continue
+			}
 			switch x.Body.(type) {
 			case *icmp.Echo:
 				msg := x.Body.(*icmp.Echo)
-				key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, 1)
+				key := t.icmpFlowKey()
 				m := &RecvMetric{
-					FlowKey:   key,
-					ID:        uint32(msg.ID),
-					RespAddr:  raddr.String(),
-					TimeStamp: time.Now(),
+					FlowKey:       key,
+					ID:            uint32(msg.ID),
+					RespAddr:      raddr.String(),
+					TimeStamp:     time.Now(),
+					ReplyTTL:      replyTTL(cm),
+					ICMPType:      int(typ),
+					ICMPCode:      code,
+					QuotedTOS:     quotedTOS(body),
+					MPLS:          mpls,
+					InterfaceInfo: ifInfo,
 				}
 				t.RecordRecv(m)
 			default:
@@ -102,12 +146,14 @@ func (t *TraceRoute) ListenWindowsIPv4ICMP() error {
 
 		if typ, ok := x.Type.(ipv4.ICMPType); ok && typ.String() == "echo reply" {
 			id := x.Body.(*icmp.Echo).ID
-			key := GetHash(t.NetSrcAddr.To4(), t.NetDstAddr.To4(), 65535, 65535, 1)
+			key := t.icmpFlowKey()
 			m := &RecvMetric{
 				FlowKey:   key,
 				ID:        uint32(id),
 				RespAddr:  raddr.String(),
 				TimeStamp: time.Now(),
+				ReplyTTL:  replyTTL(cm),
+				ICMPType:  int(ipv4.ICMPTypeEchoReply),
 			}
 			t.RecordRecv(m)
 		}